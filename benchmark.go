@@ -0,0 +1,110 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/classzz/miner-gpu/czzhash"
+)
+
+// benchStats is what a benchmark measured on one device.
+type benchStats struct {
+	id      czzhash.DeviceID
+	nonces  uint64
+	elapsed time.Duration
+	kernel  time.Duration
+	rounds  int
+	err     error
+}
+
+// benchmark hashes synthetic headers against an unreachable target on the
+// selected devices and reports the hash rate of each, so that drivers, work
+// group sizes and kernels can be compared without a node.
+func benchmark(args []string) {
+	fs := flag.NewFlagSet("benchmark", flag.ExitOnError)
+	var DurationFlag = fs.Duration("duration", 10*time.Second, "How long to hash on each device")
+	var NoncesFlag = fs.Uint64("nonces", 0, "Stop a device after this many nonces instead, 0 runs for -duration")
+	var RoundFlag = fs.Duration("round", time.Second, "Length of one Search, each round hashes a new header")
+	table := tableFlags(fs)
+	backend := backendFlags(fs, table)
+	fs.Parse(args)
+
+	Cl := backend()
+	if err := Cl.Init(0); err != nil {
+		log.Fatal("Init", "err", err)
+	}
+	defer Cl.Close()
+
+	devices := Cl.Devices()
+	log.Println("Benchmark", "devices:", len(devices), "duration:", *DurationFlag, "nonces:", *NoncesFlag)
+
+	stats := make([]benchStats, len(devices))
+	var wg sync.WaitGroup
+	for i, id := range devices {
+		wg.Add(1)
+		go func(s *benchStats, id czzhash.DeviceID) {
+			defer wg.Done()
+			*s = benchDevice(Cl, id, *DurationFlag, *NoncesFlag, *RoundFlag)
+		}(&stats[i], id)
+	}
+	wg.Wait()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tNONCES\tTIME\tHASHRATE\tKERNEL\tHOST")
+	var total float64
+	failed := false
+	for _, s := range stats {
+		if s.err != nil {
+			fmt.Fprintf(w, "%s\t%d\t%v\tfailed: %v\t\t\n", s.id, s.nonces, s.elapsed.Round(time.Millisecond), s.err)
+			failed = true
+			continue
+		}
+		rate := float64(s.nonces) / s.elapsed.Seconds()
+		total += rate
+		fmt.Fprintf(w, "%s\t%d\t%v\t%.1f H/s\t%v (%.1f%%)\t%v\n", s.id, s.nonces, s.elapsed.Round(time.Millisecond), rate,
+			s.kernel.Round(time.Millisecond), 100*s.kernel.Seconds()/s.elapsed.Seconds(), (s.elapsed - s.kernel).Round(time.Millisecond))
+	}
+	fmt.Fprintf(w, "total\t\t\t%.1f H/s\t\t\n", total)
+	w.Flush()
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// benchDevice runs rounds of Search on device id until duration has passed
+// or, if it is not 0, nonces have been hashed.
+func benchDevice(Cl czzhash.Searcher, id czzhash.DeviceID, duration time.Duration, nonces uint64, round time.Duration) benchStats {
+	s := benchStats{id: id}
+	// no hash is at most 0, the kernel never stops early
+	target := new(big.Int)
+	began := time.Now()
+	for {
+		if nonces == 0 && time.Since(began) >= duration || nonces != 0 && s.nonces >= nonces {
+			break
+		}
+		var header czzhash.Hash
+		crand.Read(header[:])
+
+		stop := make(chan struct{})
+		timer := time.AfterFunc(round, func() { close(stop) })
+		r, err := Cl.Search(header, target, Cl.Bin(), czzhash.NonceRange{Start: randomNonce(), Count: ^uint64(0)}, stop, id)
+		timer.Stop()
+		if err != nil {
+			s.err = err
+			break
+		}
+		s.nonces += r.Nonces
+		s.kernel += r.KernelTime
+		s.rounds++
+	}
+	s.elapsed = time.Since(began)
+	log.Println("Benchmark done", "device:", id, "rounds:", s.rounds, "nonces:", s.nonces)
+	return s
+}
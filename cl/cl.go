@@ -13,6 +13,12 @@ care of it (eventually) if Release isn't called. In this way you can have
 better control over the life cycle of resources while having a fall back
 to avoid leaks. This is similar to how file handles and such are handled
 in the Go standard packages.
+
+This is a fork of github.com/Gustav-Simonsson/go-opencl/cl at revision
+593e01cfc4f3, kept in the tree for the calls the miner needs on top of it:
+Device.PCIBusID, Context.CreateProgramWithBinary and Program.Binaries.
+cl_test.go is upstream's as is; main_test.go was added to skip the tests on
+hosts without an OpenCL platform.
 */
 package cl
 
@@ -0,0 +1,65 @@
+package cl
+
+// #ifdef __APPLE__
+// #include "OpenCL/opencl.h"
+// #else
+// #include "headers/1.2/cl.h"
+// #endif
+//
+// #define CL_DEVICE_TOPOLOGY_AMD           0x4037
+// #define CL_DEVICE_TOPOLOGY_TYPE_PCIE_AMD 1
+// #define CL_DEVICE_PCI_BUS_ID_NV          0x4008
+// #define CL_DEVICE_PCI_SLOT_ID_NV         0x4009
+//
+// typedef union {
+//     struct { cl_uint type; cl_uint data[5]; } raw;
+//     struct { cl_uint type; cl_char unused[17]; cl_char bus; cl_char device; cl_char function; } pcie;
+// } cl_device_topology_amd;
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// ErrNoPCIBusID is returned by PCIBusID when the driver does not report
+// where the device sits.
+var ErrNoPCIBusID = errors.New("cl: PCI bus id not reported by the driver")
+
+// PCIBusID returns the PCI address of the device as bus:device.function in
+// hex, e.g. "01:00.0". It is read from cl_amd_device_attribute_query or
+// cl_nv_device_attribute_query, whichever the device supports.
+func (d *Device) PCIBusID() (string, error) {
+	ext := d.Extensions()
+	if strings.Contains(ext, "cl_amd_device_attribute_query") {
+		var topo C.cl_device_topology_amd
+		if err := C.clGetDeviceInfo(d.id, C.CL_DEVICE_TOPOLOGY_AMD, C.size_t(unsafe.Sizeof(topo)), unsafe.Pointer(&topo), nil); err != C.CL_SUCCESS {
+			return "", toError(err)
+		}
+		pcie := (*struct {
+			typ      C.cl_uint
+			unused   [17]C.cl_char
+			bus      C.cl_char
+			device   C.cl_char
+			function C.cl_char
+		})(unsafe.Pointer(&topo))
+		if pcie.typ != C.CL_DEVICE_TOPOLOGY_TYPE_PCIE_AMD {
+			return "", ErrNoPCIBusID
+		}
+		return fmt.Sprintf("%02x:%02x.%x", uint8(pcie.bus), uint8(pcie.device), uint8(pcie.function)), nil
+	}
+	if strings.Contains(ext, "cl_nv_device_attribute_query") {
+		bus, err := d.getInfoUint(C.CL_DEVICE_PCI_BUS_ID_NV, false)
+		if err != nil {
+			return "", err
+		}
+		slot, err := d.getInfoUint(C.CL_DEVICE_PCI_SLOT_ID_NV, false)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%02x:%02x.%x", bus&0xff, slot>>3, slot&7), nil
+	}
+	return "", ErrNoPCIBusID
+}
@@ -0,0 +1,21 @@
+package cl
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// errPlatformNotFound is CL_PLATFORM_NOT_FOUND_KHR, returned by the ICD
+// loader on hosts without an OpenCL driver.
+const errPlatformNotFound = ErrOther(-1001)
+
+// TestMain skips the tests of the package on hosts without OpenCL, which
+// would fail them all for want of a platform.
+func TestMain(m *testing.M) {
+	if _, err := GetPlatforms(); err == errPlatformNotFound {
+		fmt.Println("skipping tests: no OpenCL platform")
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
@@ -0,0 +1,91 @@
+package cl
+
+// #include <stdlib.h>
+// #ifdef __APPLE__
+// #include "OpenCL/opencl.h"
+// #else
+// #include "headers/1.2/cl.h"
+// #endif
+import "C"
+
+import (
+	"runtime"
+	"unsafe"
+)
+
+// CreateProgramWithBinary creates a program for device from a binary that
+// Binaries returned for a program built for the same device and driver. The
+// program still has to be built before kernels can be created from it.
+func (ctx *Context) CreateProgramWithBinary(device *Device, binary []byte) (*Program, error) {
+	if len(binary) == 0 {
+		return nil, ErrInvalidBinary
+	}
+	cBinary := C.CBytes(binary)
+	defer C.free(cBinary)
+
+	id := device.id
+	length := C.size_t(len(binary))
+	ptr := (*C.uchar)(cBinary)
+	var status, err C.cl_int
+	clProgram := C.clCreateProgramWithBinary(ctx.clContext, 1, &id, &length, &ptr, &status, &err)
+	if err != C.CL_SUCCESS {
+		return nil, toError(err)
+	}
+	if clProgram == nil {
+		return nil, ErrUnknown
+	}
+	program := &Program{clProgram: clProgram, devices: []*Device{device}}
+	runtime.SetFinalizer(program, releaseProgram)
+	if status != C.CL_SUCCESS {
+		program.Release()
+		return nil, toError(status)
+	}
+	return program, nil
+}
+
+// Binaries returns the compiled binary of a built program for each of its
+// devices, in the order of the devices it was created for.
+func (p *Program) Binaries() ([][]byte, error) {
+	var n C.cl_uint
+	if err := C.clGetProgramInfo(p.clProgram, C.CL_PROGRAM_NUM_DEVICES, C.size_t(unsafe.Sizeof(n)), unsafe.Pointer(&n), nil); err != C.CL_SUCCESS {
+		return nil, toError(err)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	sizes := make([]C.size_t, n)
+	if err := C.clGetProgramInfo(p.clProgram, C.CL_PROGRAM_BINARY_SIZES, C.size_t(unsafe.Sizeof(sizes[0]))*C.size_t(n), unsafe.Pointer(&sizes[0]), nil); err != C.CL_SUCCESS {
+		return nil, toError(err)
+	}
+
+	// the driver writes through the pointers, so they and the memory they
+	// point to are C memory
+	var ptr *C.uchar
+	cPtrs := C.malloc(C.size_t(unsafe.Sizeof(ptr)) * C.size_t(n))
+	defer C.free(cPtrs)
+	ptrs := (*[1 << 16]*C.uchar)(cPtrs)[:n:n]
+	for i, size := range sizes {
+		ptrs[i] = nil
+		if size > 0 {
+			ptrs[i] = (*C.uchar)(C.malloc(size))
+		}
+	}
+	defer func() {
+		for _, p := range ptrs {
+			if p != nil {
+				C.free(unsafe.Pointer(p))
+			}
+		}
+	}()
+	if err := C.clGetProgramInfo(p.clProgram, C.CL_PROGRAM_BINARIES, C.size_t(unsafe.Sizeof(ptr))*C.size_t(n), cPtrs, nil); err != C.CL_SUCCESS {
+		return nil, toError(err)
+	}
+
+	binaries := make([][]byte, n)
+	for i, size := range sizes {
+		if ptrs[i] != nil {
+			binaries[i] = C.GoBytes(unsafe.Pointer(ptrs[i]), C.int(size))
+		}
+	}
+	return binaries, nil
+}
@@ -1,11 +1,10 @@
 package czzhash
 
 import (
-	"fmt"
-	"io/ioutil"
-	"os"
+	"log"
+	"math/big"
 	"sync"
-	"sync/atomic"
+	"time"
 )
 
 const (
@@ -13,17 +12,31 @@ const (
 	HashLength = 32
 )
 
-type Csatable [TBLSize]byte
+// Csatable is the TBLSize byte czzhash table. It lives on the heap or, when
+// loaded with LoadTable, in a read-only mapping of the table file that is
+// released once the Csatable is garbage collected.
+type Csatable struct {
+	data []byte
+}
+
 type Hash [HashLength]byte
 
-func (c Csatable) Bytes() []byte { return c[:TBLSize] }
+// NewCsatable returns a zeroed table on the heap.
+func NewCsatable() *Csatable {
+	return &Csatable{data: make([]byte, TBLSize)}
+}
 
-// Sets the hash to the value of b. If b is larger than len(h) it will panic
+// Bytes returns the table without copying it. The slice must not be written
+// to and is only valid as long as c is reachable.
+func (c *Csatable) Bytes() []byte { return c.data }
+
+// Sets the table to the value of b. If b is larger than the table it will be
+// cropped from the left. Only tables from NewCsatable can be set.
 func (c *Csatable) SetBytes(b []byte) {
-	if len(b) > len(c.Bytes()) {
+	if len(b) > TBLSize {
 		b = b[len(b)-TBLSize:]
 	}
-	copy(c[TBLSize-len(b):], b)
+	copy(c.data[TBLSize-len(b):], b)
 }
 
 // SetBytes sets the hash to the value of b.
@@ -37,36 +50,115 @@ func (h *Hash) SetBytes(b []byte) {
 
 // Full implements the Search half of the proof of work.
 type Full struct {
-	hashRate int32
+	Metrics  *Metrics   // nonces hashed per device
 	mu       sync.Mutex // protects bin
 	Csatable *Csatable  // current full Bin
+	Epoch    uint64     // of Csatable
+	Table    TableConfig
+	tables   *TableManager
 }
 
-func (pow *Full) GetBin(blockNum uint64) *Csatable {
-
-	if pow.Csatable != nil {
-		return pow.Csatable
+// GetBin returns the table of the epoch of blockNum, loading it as configured
+// by pow.Table, and makes it the current one unless that is of a later
+// epoch. A Csatable set without a Table is used for every block. Errors are
+// *TableError.
+func (pow *Full) GetBin(blockNum uint64) (*Csatable, error) {
+	pow.mu.Lock()
+	if pow.tables == nil {
+		if pow.Csatable != nil {
+			defer pow.mu.Unlock()
+			return pow.Csatable, nil
+		}
+		pow.tables = NewTableManager(pow.Table)
 	}
-	file, err := os.Open("csatable.bin")
+	tables, current := pow.tables, pow.Csatable
+	epoch := tables.Epoch(blockNum)
+	if current != nil && pow.Epoch == epoch {
+		pow.mu.Unlock()
+		return current, nil
+	}
+	pow.mu.Unlock()
+
+	// loaded without holding mu, the devices keep hashing with the current
+	// table meanwhile
+	tbl, err := tables.Table(epoch)
 	if err != nil {
-		fmt.Println(err)
+		return nil, err
 	}
-	defer file.Close()
-	stats, _ := file.Stat()
-	var size = uint64(stats.Size())
-	if size != TBLSize {
-		fmt.Printf("file size is %d\n", size)
-		return &Csatable{}
+
+	pow.mu.Lock()
+	defer pow.mu.Unlock()
+	if pow.Csatable == nil || epoch > pow.Epoch {
+		if pow.Csatable != nil {
+			log.Println("Table switched", "epoch:", epoch, "block:", blockNum)
+		}
+		pow.Csatable, pow.Epoch = tbl, epoch
 	}
-	csa, err := ioutil.ReadAll(file)
-	cast := &Csatable{}
-	cast.SetBytes(csa)
+	return tbl, nil
+}
 
-	return cast
+// bin returns the current table.
+func (pow *Full) bin() *Csatable {
+	pow.mu.Lock()
+	defer pow.mu.Unlock()
+	return pow.Csatable
 }
 
-func (pow *Full) GetHashrate() int64 {
-	return int64(atomic.LoadInt32(&pow.hashRate))
+// Searcher is implemented by every mining backend. Devices are addressed by
+// the DeviceIDs Devices returns.
+type Searcher interface {
+	// Init loads the Bin for blockNum and prepares the devices.
+	Init(blockNum uint64) error
+	// Search hashes header with tbl and the nonces of nonces until nonces
+	// whose hash is at most the 256 bit target are found, the range is done
+	// or stop is closed. tbl is the table of the epoch of the work, as
+	// returned by Update; a device that hashed with another one switches to
+	// it first. The nonces hashed are the first Nonces of the range, so a
+	// search can go on after them, and every nonce found among them is
+	// returned in Found, which is empty if there is none. Device failures are
+	// returned as *DeviceError.
+	Search(hash [32]byte, target *big.Int, tbl *Csatable, nonces NonceRange, stop <-chan struct{}, id DeviceID) (*Result, error)
+	// Reset reinitialises a device after Search failed on it.
+	Reset(id DeviceID) error
+	// Update returns the table of the epoch of blockNum, loading it if it
+	// is not loaded yet, for the Searches of work at blockNum. Bin moves on
+	// to it unless it is of an earlier epoch.
+	Update(blockNum uint64) (*Csatable, error)
+	// Devices returns the devices that were initialised.
+	Devices() []DeviceID
+	// Metrics counts the nonces each device hashes while it hashes them.
+	Metrics() *Metrics
+	// Bin returns the table the devices hash with, for host side checks.
+	Bin() *Csatable
+	// Close releases the resources held by the backend. It waits for the
+	// Searches in flight, which end at the end of their range or once their
+	// stop is closed, so it should be called after closing their stops. A
+	// Search after Close fails with ErrUnknownDevice.
+	Close() error
+}
+
+// NonceRange is the Count nonces from Start on, wrapping around at 2^64.
+type NonceRange struct {
+	Start uint64
+	Count uint64
+}
+
+// Contains reports whether nonce is in r.
+func (r NonceRange) Contains(nonce uint64) bool {
+	return nonce-r.Start < r.Count
+}
+
+type Result struct {
+	Nonces uint64   // hashed, from the start of the range on
+	Found  []uint64 // hash to at most the target, in range order
+	// Dropped is how many nonces among the ones hashed hash to at most the
+	// target but are missing from Found, because a device could not return
+	// them all. It is counted in the Metrics too.
+	Dropped uint64
+	// KernelTime is the part of the Search spent hashing: the time the
+	// kernels ran on an OpenCL device, from its profiling timestamps, or the
+	// time the threads of the CPU backend ran. The rest is host overhead.
+	KernelTime time.Duration
 }
 
 type CzzHash struct {
@@ -75,5 +167,11 @@ type CzzHash struct {
 
 // New creates an instance of the proof of work.
 func New() *CzzHash {
-	return &CzzHash{&Full{}}
+	return &CzzHash{&Full{Metrics: NewMetrics()}}
+}
+
+// NewTable creates an instance of the proof of work that loads its table as
+// configured by table.
+func NewTable(table TableConfig) *CzzHash {
+	return &CzzHash{&Full{Metrics: NewMetrics(), Table: table}}
 }
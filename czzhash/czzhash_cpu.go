@@ -0,0 +1,186 @@
+package czzhash
+
+import (
+	"log"
+	"math/big"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CPUDevice is the single device of CPUMiner.
+const CPUDevice DeviceID = "cpu"
+
+// CPUMiner is a pure-Go Searcher. It exposes a single device, CPUDevice,
+// that hashes on the host with a configurable number of goroutines, so mining and tests work
+// on machines without an OpenCL GPU.
+type CPUMiner struct {
+	czzhash *CzzHash // classzz full Bin in host mem
+	threads int
+
+	mu     sync.Mutex // protects bin and hasher
+	bin    *Csatable  // the Bin of hasher, the last one searched with
+	hasher *Hasher
+}
+
+// NewCPU returns a CPU backend using threads goroutines, or one per logical
+// CPU if threads is not positive, that hashes with the table of table.
+func NewCPU(threads int, table TableConfig) *CPUMiner {
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	return &CPUMiner{
+		czzhash: NewTable(table),
+		threads: threads,
+	}
+}
+
+// Init implements Searcher.
+func (c *CPUMiner) Init(blockNum uint64) error {
+	bin, err := c.czzhash.GetBin(blockNum)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Initialising CPU device", "threads:", c.threads)
+	hasher := NewHasher(bin)
+	c.mu.Lock()
+	c.bin, c.hasher = bin, hasher
+	c.mu.Unlock()
+	return nil
+}
+
+// Bin implements Searcher.
+func (c *CPUMiner) Bin() *Csatable {
+	return c.czzhash.bin()
+}
+
+// Update implements Searcher. The CPU device switches to the Bin at the
+// start of the first Search with it, a running Search keeps its own.
+func (c *CPUMiner) Update(blockNum uint64) (*Csatable, error) {
+	return c.czzhash.GetBin(blockNum)
+}
+
+// Close implements Searcher.
+func (c *CPUMiner) Close() error {
+	c.mu.Lock()
+	c.bin, c.hasher = nil, nil
+	c.mu.Unlock()
+	return nil
+}
+
+// Metrics implements Searcher.
+func (c *CPUMiner) Metrics() *Metrics {
+	return c.czzhash.Metrics
+}
+
+// Devices implements Searcher.
+func (c *CPUMiner) Devices() []DeviceID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hasher == nil {
+		return nil
+	}
+	return []DeviceID{CPUDevice}
+}
+
+// Search implements Searcher.
+func (c *CPUMiner) Search(hash [32]byte, target *big.Int, tbl *Csatable, nonces NonceRange, stop <-chan struct{}, id DeviceID) (*Result, error) {
+	var hasher *Hasher
+	if id == CPUDevice {
+		hasher = c.hasherOf(tbl)
+	}
+	if hasher == nil {
+		return nil, &DeviceError{Device: id, Op: "search", Err: ErrUnknownDevice}
+	}
+	return c.search(hasher, hash, target, nonces, stop), nil
+}
+
+// hasherOf returns the hasher of tbl, switching to it if the last Search
+// hashed with another Bin. It is nil before Init and after Close.
+func (c *CPUMiner) hasherOf(tbl *Csatable) *Hasher {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hasher == nil {
+		return nil
+	}
+	// work of another epoch, see Update
+	if tbl != c.bin {
+		log.Println("Switching Bin", "device:", CPUDevice)
+		c.bin, c.hasher = tbl, NewHasher(tbl)
+	}
+	return c.hasher
+}
+
+// Reset implements Searcher. The CPU device has nothing to reinitialise.
+func (c *CPUMiner) Reset(id DeviceID) error {
+	return nil
+}
+
+// cpuBatch is how many nonces a thread takes at a time. The nonces of a
+// batch are all hashed before the metrics are updated once for them.
+const cpuBatch = 64
+
+// search hashes nonces with hasher on c.threads goroutines, each taking the
+// next batch of the range until a nonce hashing to at most bound is found,
+// the range is done or stop is closed. A batch taken is always hashed to its
+// end, so the nonces hashed are the first su.Nonces of the range and su.Found
+// holds every nonce among them that hashes to at most bound, in range order.
+func (c *CPUMiner) search(hasher *Hasher, hash Hash, bound *big.Int, nonces NonceRange, stop <-chan struct{}) *Result {
+	var (
+		next  uint64     // offset of the next batch, counted from nonces.Start
+		found int32      // set once a nonce is found, no batch is taken after
+		mu    sync.Mutex // protects su
+		wg    sync.WaitGroup
+		su    = &Result{}
+	)
+	began := time.Now()
+	for t := 0; t < c.threads; t++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&found) == 0 {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				offset := atomic.AddUint64(&next, cpuBatch) - cpuBatch
+				if offset >= nonces.Count {
+					return
+				}
+				n := nonces.Count - offset
+				if n > cpuBatch {
+					n = cpuBatch
+				}
+
+				var hits []uint64
+				for i := uint64(0); i < n; i++ {
+					nonce := nonces.Start + offset + i
+					if HashToBig(hasher.Hash(hash, nonce)).Cmp(bound) <= 0 {
+						hits = append(hits, nonce)
+					}
+				}
+				c.czzhash.Metrics.Add(CPUDevice, n)
+
+				mu.Lock()
+				su.Nonces += n
+				su.Found = append(su.Found, hits...)
+				mu.Unlock()
+				if len(hits) > 0 {
+					atomic.StoreInt32(&found, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the batches were hashed in whatever order the threads got to them
+	sort.Slice(su.Found, func(i, j int) bool {
+		return su.Found[i]-nonces.Start < su.Found[j]-nonces.Start
+	})
+	su.KernelTime = time.Since(began)
+	return su
+}
@@ -0,0 +1,106 @@
+package czzhash
+
+import (
+	"math/big"
+	"sort"
+	"sync"
+	"testing"
+)
+
+var (
+	testHasherOnce sync.Once
+	testHasher     *Hasher
+)
+
+// hasherForTest returns the Hasher of the table of the first vector seed,
+// built once for all tests.
+func hasherForTest() *Hasher {
+	testHasherOnce.Do(func() {
+		testHasher = NewHasher(TestTable(Vectors[0].TableSeed))
+	})
+	return testHasher
+}
+
+// TestCPUSearchResumes searches a range the way the miner does, going on
+// after the nonces each search hashed, and expects every nonce below the
+// target exactly once, in range order.
+func TestCPUSearchResumes(t *testing.T) {
+	hasher := hasherForTest()
+	var header Hash
+	copy(header[:], "czzhash cpu search test header")
+	// the range wraps around at 2^64
+	r := NonceRange{Start: ^uint64(0) - 100, Count: 3 * cpuBatch}
+
+	hashes := make([]*big.Int, r.Count)
+	for i := range hashes {
+		hashes[i] = HashToBig(hasher.Hash(header, r.Start+uint64(i)))
+	}
+	sorted := append([]*big.Int(nil), hashes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Cmp(sorted[j]) < 0 })
+	bound := sorted[7]
+	var want []uint64
+	for i, h := range hashes {
+		if h.Cmp(bound) <= 0 {
+			want = append(want, r.Start+uint64(i))
+		}
+	}
+
+	c := &CPUMiner{czzhash: New(), threads: 4}
+	var got []uint64
+	for nonces, searches := r, 0; nonces.Count > 0; searches++ {
+		if searches > int(r.Count) {
+			t.Fatal("search makes no progress")
+		}
+		su := c.search(hasher, header, bound, nonces, nil)
+		if su.Nonces == 0 || su.Nonces > nonces.Count {
+			t.Fatalf("hashed %d of %d nonces", su.Nonces, nonces.Count)
+		}
+		hashed := NonceRange{Start: nonces.Start, Count: su.Nonces}
+		for _, nonce := range su.Found {
+			if !hashed.Contains(nonce) {
+				t.Fatalf("found %#x outside the %d nonces hashed from %#x", nonce, su.Nonces, nonces.Start)
+			}
+		}
+		got = append(got, su.Found...)
+		nonces.Start += su.Nonces
+		nonces.Count -= su.Nonces
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("found %#x, want %#x", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("found %#x, want %#x", got, want)
+		}
+	}
+}
+
+func TestCPUSearchStop(t *testing.T) {
+	stop := make(chan struct{})
+	close(stop)
+	c := &CPUMiner{czzhash: New(), threads: 2}
+	su := c.search(hasherForTest(), Hash{}, maxTarget, NonceRange{Start: 0, Count: 1 << 20}, stop)
+	if su.Nonces != 0 || len(su.Found) != 0 {
+		t.Fatalf("stopped search hashed %d nonces and found %#x", su.Nonces, su.Found)
+	}
+}
+
+func TestCPUSearchFindsWholeBatch(t *testing.T) {
+	// every hash is at most maxTarget, each thread stops after its first
+	// batch and every nonce of it is found
+	c := &CPUMiner{czzhash: New(), threads: 2}
+	r := NonceRange{Start: 1000, Count: 10 * cpuBatch}
+	su := c.search(hasherForTest(), Hash{}, maxTarget, r, nil)
+	if su.Nonces == 0 || su.Nonces%cpuBatch != 0 || su.Nonces > 2*cpuBatch {
+		t.Fatalf("hashed %d nonces, want one or two batches", su.Nonces)
+	}
+	if uint64(len(su.Found)) != su.Nonces {
+		t.Fatalf("found %d of the %d nonces hashed", len(su.Found), su.Nonces)
+	}
+	for i, nonce := range su.Found {
+		if nonce != r.Start+uint64(i) {
+			t.Fatalf("found %v, want the nonces from %d on in order", su.Found, r.Start)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package czzhash
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// DeviceID identifies a device by platform, position among the devices of
+// that platform and PCI bus id if known, e.g. "1.0@01:00.0". Unlike an index
+// into the devices of all platforms it stays the same when the devices of
+// other platforms come and go.
+type DeviceID string
+
+// deviceID returns the DeviceID of device n of platform p at bus.
+func deviceID(p, n int, bus string) DeviceID {
+	id := fmt.Sprintf("%d.%d", p, n)
+	if bus != "" {
+		id += "@" + bus
+	}
+	return DeviceID(id)
+}
+
+// DeviceInfo describes an OpenCL GPU.
+type DeviceInfo struct {
+	ID            DeviceID `json:"id"`
+	Index         int      `json:"index"` // among the GPUs of all platforms, for the command line
+	Platform      string   `json:"platform"`
+	Name          string   `json:"name"`
+	Vendor        string   `json:"vendor"`
+	DriverVersion string   `json:"driver_version"`
+	Version       string   `json:"opencl_version"`
+	PCIBusID      string   `json:"pci_bus_id"` // bus:device.function, empty if the driver does not tell
+
+	ComputeUnits     int   `json:"compute_units"`
+	MaxWorkGroupSize int   `json:"max_work_group_size"`
+	GlobalMemSize    int64 `json:"global_mem_size"`
+	MaxMemAllocSize  int64 `json:"max_mem_alloc_size"`
+	// TableFits reports whether the device says it can hold the table.
+	TableFits bool `json:"table_fits"`
+}
+
+// DeviceConfig selects and tunes one OpenCL device. Zero values pick the
+// defaults.
+type DeviceConfig struct {
+	ID DeviceID
+
+	WorkGroupSize   int // work items per group, a multiple of 8
+	BatchMultiplier int // work groups per compute unit in one dispatch
+	Intensity       int // log2 of the nonces hashed per dispatch, overrides BatchMultiplier
+}
+
+// Match reports whether pattern names the device: by index ("2"), by ID
+// ("1.0@01:00.0"), by PCI bus
+// id ("01:00.0", an optional "0000:" domain is ignored) or by a
+// case-insensitive path.Match pattern on the name ("*RX 580*").
+func (d *DeviceInfo) Match(pattern string) bool {
+	if i, err := strconv.Atoi(pattern); err == nil {
+		return i == d.Index
+	}
+	if DeviceID(pattern) == d.ID {
+		return true
+	}
+	if d.PCIBusID != "" && strings.Count(pattern, ":") > 0 && strings.Contains(pattern, ".") {
+		bus := strings.ToLower(pattern)
+		if strings.Count(bus, ":") == 2 {
+			bus = bus[strings.Index(bus, ":")+1:]
+		}
+		if bus == d.PCIBusID {
+			return true
+		}
+	}
+	ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(d.Name))
+	return ok
+}
+
+// SelectDevices returns the devices matching any of include, every device if
+// include is empty, minus those matching any of exclude. An include pattern
+// matching no device is an error, as is selecting no device at all.
+func SelectDevices(devices []DeviceInfo, include, exclude []string) ([]DeviceInfo, error) {
+	for _, patterns := range [][]string{include, exclude} {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("device pattern %q: %v", p, err)
+			}
+		}
+	}
+	for _, p := range include {
+		found := false
+		for i := range devices {
+			found = found || devices[i].Match(p)
+		}
+		if !found {
+			return nil, fmt.Errorf("no device matches %q", p)
+		}
+	}
+
+	var selected []DeviceInfo
+	for i := range devices {
+		d := &devices[i]
+		if len(include) > 0 && !matchAny(d, include) {
+			continue
+		}
+		if matchAny(d, exclude) {
+			continue
+		}
+		selected = append(selected, *d)
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("No GPU devices selected")
+	}
+	return selected, nil
+}
+
+func matchAny(d *DeviceInfo, patterns []string) bool {
+	for _, p := range patterns {
+		if d.Match(p) {
+			return true
+		}
+	}
+	return false
+}
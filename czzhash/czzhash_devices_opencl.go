@@ -0,0 +1,124 @@
+//go:build !nocl
+// +build !nocl
+
+package czzhash
+
+import (
+	"fmt"
+
+	"github.com/classzz/miner-gpu/cl"
+)
+
+// Registry holds the GPUs of all platforms.
+type Registry struct {
+	infos   []DeviceInfo
+	devices []*cl.Device
+}
+
+// NewRegistry enumerates the GPUs of all platforms.
+func NewRegistry() (*Registry, error) {
+	gs, err := gpus()
+	if err != nil {
+		return nil, err
+	}
+	r := &Registry{devices: make([]*cl.Device, len(gs)), infos: make([]DeviceInfo, len(gs))}
+	for i, g := range gs {
+		d := g.device
+		bus, _ := d.PCIBusID()
+		r.devices[i] = d
+		r.infos[i] = DeviceInfo{
+			ID:               deviceID(g.platformIndex, g.index, bus),
+			Index:            i,
+			Platform:         g.platform.Name(),
+			Name:             d.Name(),
+			Vendor:           d.Vendor(),
+			DriverVersion:    d.DriverVersion(),
+			Version:          d.Version(),
+			PCIBusID:         bus,
+			ComputeUnits:     d.MaxComputeUnits(),
+			MaxWorkGroupSize: d.MaxWorkGroupSize(),
+			GlobalMemSize:    d.GlobalMemSize(),
+			MaxMemAllocSize:  d.MaxMemAllocSize(),
+			TableFits:        d.GlobalMemSize() >= TBLSize && d.MaxMemAllocSize() >= TBLSize,
+		}
+	}
+	return r, nil
+}
+
+// Devices describes the GPUs in the order of their Index.
+func (r *Registry) Devices() []DeviceInfo {
+	infos := make([]DeviceInfo, len(r.infos))
+	copy(infos, r.infos)
+	return infos
+}
+
+// Lookup returns the GPU id.
+func (r *Registry) Lookup(id DeviceID) (*cl.Device, bool) {
+	for i := range r.infos {
+		if r.infos[i].ID == id {
+			return r.devices[i], true
+		}
+	}
+	return nil, false
+}
+
+// Devices describes the GPUs of all platforms.
+func Devices() ([]DeviceInfo, error) {
+	r, err := NewRegistry()
+	if err != nil {
+		return nil, err
+	}
+	return r.Devices(), nil
+}
+
+// gpu is a GPU and where it was found.
+type gpu struct {
+	device        *cl.Device
+	platform      *cl.Platform
+	platformIndex int
+	index         int // among the GPUs of platform
+}
+
+// gpus returns the GPUs of all platforms.
+func gpus() ([]gpu, error) {
+	platforms, err := cl.GetPlatforms()
+	if err != nil {
+		return nil, fmt.Errorf("Platform error: %v\nCheck your OpenCL installation", err)
+	}
+	var found []gpu
+	for pi, p := range platforms {
+		ds, err := cl.GetDevices(p, cl.DeviceTypeGPU)
+		if err == cl.ErrDeviceNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Devices error: %v\nCheck your GPU drivers", err)
+		}
+		for i, d := range ds {
+			found = append(found, gpu{device: d, platform: p, platformIndex: pi, index: i})
+		}
+	}
+	return found, nil
+}
+
+// check validates the tuning of cfg against the limits device reports.
+func (cfg *DeviceConfig) check(device *cl.Device) error {
+	if cfg.WorkGroupSize < 0 || cfg.WorkGroupSize%8 != 0 {
+		return fmt.Errorf("work group size %d is not a multiple of 8", cfg.WorkGroupSize)
+	}
+	if max := device.MaxWorkGroupSize(); cfg.WorkGroupSize > max {
+		return fmt.Errorf("work group size %d exceeds the device maximum of %d", cfg.WorkGroupSize, max)
+	}
+	if cfg.BatchMultiplier < 0 {
+		return fmt.Errorf("batch multiplier %d is negative", cfg.BatchMultiplier)
+	}
+	if cfg.Intensity != 0 {
+		if cfg.Intensity < 8 || cfg.Intensity > 30 {
+			return fmt.Errorf("intensity %d is not between 8 and 30", cfg.Intensity)
+		}
+		if cfg.WorkGroupSize != 0 && (1<<uint(cfg.Intensity))%cfg.WorkGroupSize != 0 {
+			return fmt.Errorf("intensity %d does not fit work groups of %d", cfg.Intensity, cfg.WorkGroupSize)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package czzhash
+
+import (
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// EpochPath is where the table of epoch is read from when the table of epoch
+// 0 is at path: csatable.bin, csatable-1.bin, csatable-2.bin, ...
+func EpochPath(path string, epoch uint64) string {
+	if epoch == 0 {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + strconv.FormatUint(epoch, 10) + ext
+}
+
+// epochTable is a table that is being or has been loaded.
+type epochTable struct {
+	done chan struct{} // closed once tbl or err is set
+	tbl  *Csatable
+	err  error
+}
+
+// TableManager hands out the table of the epoch a block belongs to. Epochs
+// are cfg.EpochLength blocks long, with an EpochLength of 0 there is a
+// single table. Each epoch has its own table file, see EpochPath, and the
+// table of the next epoch is loaded in the background as soon as one is
+// used. Only the current and the next table are kept in memory.
+type TableManager struct {
+	cfg TableConfig
+
+	mu     sync.Mutex // protects tables
+	tables map[uint64]*epochTable
+}
+
+// NewTableManager returns a manager for the tables configured by cfg.
+func NewTableManager(cfg TableConfig) *TableManager {
+	return &TableManager{
+		cfg:    cfg,
+		tables: make(map[uint64]*epochTable),
+	}
+}
+
+// Epoch returns the epoch of blockNum.
+func (m *TableManager) Epoch(blockNum uint64) uint64 {
+	if m.cfg.EpochLength == 0 {
+		return 0
+	}
+	return blockNum / m.cfg.EpochLength
+}
+
+// Table returns the table of epoch, waiting for it to be loaded. Errors are
+// *TableError.
+func (m *TableManager) Table(epoch uint64) (*Csatable, error) {
+	e := m.start(epoch)
+	<-e.done
+
+	m.mu.Lock()
+	if e.err != nil {
+		// let the next call try again
+		if m.tables[epoch] == e {
+			delete(m.tables, epoch)
+		}
+		m.mu.Unlock()
+		return nil, e.err
+	}
+	for ep := range m.tables {
+		if ep != epoch && ep != epoch+1 {
+			delete(m.tables, ep)
+		}
+	}
+	m.mu.Unlock()
+
+	if m.cfg.EpochLength != 0 {
+		m.start(epoch + 1)
+	}
+	return e.tbl, nil
+}
+
+// start begins loading the table of epoch unless that is done already.
+func (m *TableManager) start(epoch uint64) *epochTable {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.tables[epoch]; ok {
+		return e
+	}
+	e := &epochTable{done: make(chan struct{})}
+	m.tables[epoch] = e
+	go func() {
+		e.tbl, e.err = m.load(epoch)
+		close(e.done)
+	}()
+	return e
+}
+
+// load reads the table of epoch from disk.
+func (m *TableManager) load(epoch uint64) (*Csatable, error) {
+	path := EpochPath(TablePath(m.cfg.Path), epoch)
+	if m.cfg.Unverified {
+		return LoadTable(path, "")
+	}
+
+	digest := m.cfg.digest(epoch)
+	tbl, err := LoadTable(path, digest)
+	if err == nil && digest == "" {
+		log.Println("WARNING: ******************************************************************")
+		log.Println("WARNING: table loaded WITHOUT a digest check", "path:", path, "digest:", TableDigest(tbl))
+		log.Println("WARNING: no digest is known for it; a wrong or damaged table makes every share invalid")
+		log.Println("WARNING: pass -table-digest to check it, or -no-table-digest to silence this")
+		log.Println("WARNING: ******************************************************************")
+	}
+	return tbl, err
+}
@@ -0,0 +1,50 @@
+package czzhash
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of device failures, see DeviceError.
+var (
+	// ErrDeviceLost means the device stopped working, it may come back
+	// after it is reinitialised.
+	ErrDeviceLost = errors.New("device lost")
+	// ErrOutOfResources means the device or host ran out of memory.
+	ErrOutOfResources = errors.New("out of resources")
+	// ErrBuildFailure means the kernel does not build for the device,
+	// reinitialising will not help.
+	ErrBuildFailure = errors.New("kernel build failure")
+)
+
+// ErrUnknownDevice means a device was addressed that the backend does not
+// have.
+var ErrUnknownDevice = errors.New("unknown device")
+
+// DeviceError is a failure of one device. Kind is ErrDeviceLost,
+// ErrOutOfResources, ErrBuildFailure or nil if the failure is of no known
+// kind, e.g. an unsupported device.
+type DeviceError struct {
+	Device DeviceID
+	Op     string
+	Kind   error
+	Err    error
+}
+
+func (e *DeviceError) Error() string {
+	if e.Kind == nil {
+		return fmt.Sprintf("device %s: %s: %v", e.Device, e.Op, e.Err)
+	}
+	return fmt.Sprintf("device %s: %s: %v (%v)", e.Device, e.Op, e.Err, e.Kind)
+}
+
+// Unwrap returns the underlying OpenCL error.
+func (e *DeviceError) Unwrap() error { return e.Err }
+
+// Is reports whether target is the kind of e.
+func (e *DeviceError) Is(target error) bool { return e.Kind != nil && target == e.Kind }
+
+// buildError wraps err from compiling the kernel.
+func buildError(device DeviceID, op string, err error) error {
+	return &DeviceError{Device: device, Op: op, Kind: ErrBuildFailure, Err: err}
+}
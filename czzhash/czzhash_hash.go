@@ -0,0 +1,190 @@
+package czzhash
+
+import (
+	"encoding/binary"
+	"math/big"
+	"math/bits"
+	"runtime"
+	"sync"
+
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	rowSize     = 256               // bytes per Csatable row, one 2048 bit vector
+	rowWords    = rowSize / 8       // row size in uint64 words
+	segmentRows = 2048              // rows scrambled per round
+	segmentSize = segmentRows * 256 // bytes per table segment (524288 in the kernel)
+	segments    = TBLSize / segmentSize
+	hashRounds  = 64
+)
+
+// Hasher computes czzhash on the host. It is the Go counterpart of
+// compute_hash_chunks in the OpenCL kernel.
+//
+// Every table row is decrypted with a key derived only from the table itself,
+// so the decryption is done once in NewHasher and a hash is reduced to 64
+// rounds of parity products over the decrypted rows.
+type Hasher struct {
+	rows []uint64 // decrypted Csatable, rowWords words per row
+}
+
+// NewHasher decrypts the table and returns a Hasher for it.
+func NewHasher(c *Csatable) *Hasher {
+	tbl := c.Bytes()
+	h := &Hasher{rows: make([]uint64, TBLSize/8)}
+
+	var wg sync.WaitGroup
+	next := make(chan int, segments)
+	for it := 0; it < segments; it++ {
+		next <- it
+	}
+	close(next)
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for it := range next {
+				h.decodeSegment(tbl, it)
+			}
+		}()
+	}
+	wg.Wait()
+	runtime.KeepAlive(c)
+	return h
+}
+
+// decodeSegment decrypts the rows of segment it the way czz_scramble does.
+func (h *Hasher) decodeSegment(tbl []byte, it int) {
+	cw := [8]byte{byte(it), 0xe0, 0x1b, 0x02, 0xc9, 0xe0, 0x45, 0xee}
+	var sch [56]byte
+	var data [rowSize]byte
+
+	base := it * segmentSize
+	for k := 0; k < segmentRows; k++ {
+		row := tbl[base+k*rowSize : base+(k+1)*rowSize]
+		keySchedule(cw[:], &sch)
+		copy(cw[:], row)
+		copy(data[:], row)
+
+		wordDec(&sch, data[0:8])
+		for i := 8; i < rowSize; i += 8 {
+			for j := 0; j < 8; j++ {
+				data[i-8+j] ^= data[i+j]
+			}
+			wordDec(&sch, data[i:i+8])
+		}
+
+		out := h.rows[(base+k*rowSize)/8:]
+		for j := 0; j < rowWords; j++ {
+			out[j] = binary.LittleEndian.Uint64(data[j*8:])
+		}
+	}
+}
+
+// Hash returns czzhash of header and nonce, in the byte order of
+// chainhash.HashCZZ (the kernel writes it reversed).
+func (h *Hasher) Hash(header Hash, nonce uint64) Hash {
+	var seed [64]byte
+	binary.BigEndian.PutUint32(seed[0:], uint32(nonce))
+	binary.BigEndian.PutUint32(seed[4:], uint32(nonce>>32))
+	copy(seed[8:], header[:])
+
+	var in, out [rowSize]byte
+	sum := sha3.Sum512(seed[:])
+	for i := 0; i < 64; i++ {
+		in[i] = sum[63-i]
+	}
+	copy(in[64:], in[:64])
+	copy(in[128:], in[:128])
+
+	var vec [rowWords]uint64
+	for k := 0; k < hashRounds; k++ {
+		sf := uint(in[0] & 0x7f)
+		it := (k/16)*16 + int(in[rowSize-1]>>4)
+
+		for j := range vec {
+			vec[j] = binary.LittleEndian.Uint64(in[j*8:])
+		}
+		out = [rowSize]byte{}
+		rows := h.rows[it*segmentSize/8:]
+		for r := 0; r < segmentRows; r++ {
+			row := rows[r*rowWords : (r+1)*rowWords]
+			var acc uint64
+			for j, w := range row {
+				acc ^= vec[j] & w
+			}
+			out[r/8] |= byte(bits.OnesCount64(acc)&1) << uint(r%8)
+		}
+		shift(&in, &out, sf)
+	}
+
+	for i := 0; i < rowSize; i += 4 {
+		in[i], in[i+1], in[i+2], in[i+3] = in[i+3], in[i+2], in[i+1], in[i]
+	}
+	return Hash(sha3.Sum256(in[:]))
+}
+
+// keySchedule expands the 8 byte control word into the 56 byte cipher key.
+func keySchedule(cw []byte, sch *[56]byte) {
+	var k [7]uint64
+	k[6] = binary.LittleEndian.Uint64(cw)
+	for i := 6; i > 0; i-- {
+		var n uint64
+		v := k[i]
+		for j := 0; j < 8; j++ {
+			n |= czaKperm[j][v&0xff]
+			v >>= 8
+		}
+		k[i-1] = n
+	}
+	for i := 0; i < 7; i++ {
+		for j := 0; j < 8; j++ {
+			sch[i*8+j] = byte(k[i]>>uint(j*8)) ^ byte(i)
+		}
+	}
+}
+
+// wordDec decrypts one 8 byte block in place.
+func wordDec(sch *[56]byte, w []byte) {
+	for i := len(sch) - 1; i >= 0; i-- {
+		s := czaSbox[sch[i]^w[6]]
+		l := w[7] ^ s
+
+		w[7] = w[6]
+		w[6] = w[5] ^ czaPerm[s]
+		w[5] = w[4]
+		w[4] = w[3] ^ l
+		w[3] = w[2] ^ l
+		w[2] = w[1] ^ l
+		w[1] = w[0]
+		w[0] = l
+	}
+}
+
+// shift rotates the 2048 bit vector in right by sf bits into out.
+func shift(out, in *[rowSize]byte, sf uint) {
+	sfI := int(sf / 8)
+	sfR := sf % 8
+	mask := byte(1<<sfR) - 1
+	width := 8 - sfR
+
+	copy(out[:], in[sfI:])
+	copy(out[rowSize-sfI:], in[:sfI])
+
+	res := (out[0] & mask) << width
+	for k := 0; k < rowSize-1; k++ {
+		out[k] = (out[k] >> sfR) + (out[k+1]&mask)<<width
+	}
+	out[rowSize-1] = (out[rowSize-1] >> sfR) + res
+}
+
+// HashToBig converts a hash as returned by Hasher.Hash into the number that
+// is compared against the target.
+func HashToBig(h Hash) *big.Int {
+	var buf Hash
+	for i := 0; i < HashLength; i++ {
+		buf[i] = h[HashLength-1-i]
+	}
+	return new(big.Int).SetBytes(buf[:])
+}
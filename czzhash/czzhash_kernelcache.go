@@ -0,0 +1,106 @@
+//go:build !nocl
+// +build !nocl
+
+package czzhash
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/classzz/miner-gpu/cl"
+	"golang.org/x/crypto/sha3"
+)
+
+// kernelCachePath returns the file in dir the kernel built for device with
+// opts is cached in. The name holds the device name and driver version and
+// a digest of the kernel source and opts, so a driver update or another
+// kernel never picks up a stale binary.
+func kernelCachePath(dir string, device *cl.Device, opts string) string {
+	sum := sha3.Sum256([]byte(Kernel + "\x00" + opts))
+	name := fmt.Sprintf("%s-%s-%x.bin", cacheName(device.Name()), cacheName(device.DriverVersion()), sum[:8])
+	return filepath.Join(dir, name)
+}
+
+// cacheName replaces what may not go into a file name with underscores.
+func cacheName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.':
+			return r
+		}
+		return '_'
+	}, strings.TrimSpace(s))
+}
+
+// buildProgram returns the kernel program for device, built with opts. With
+// a cache dir the binary cached for device is loaded if there is one, else
+// the source is built and its binary cached. A cached binary the driver
+// rejects is removed and the source built instead. Errors come with the
+// operation that failed.
+func buildProgram(ctx *cl.Context, device *cl.Device, dir, opts string) (*cl.Program, string, error) {
+	var path string
+	if dir != "" {
+		path = kernelCachePath(dir, device, opts)
+		if binary, err := ioutil.ReadFile(path); err == nil {
+			program, err := loadProgram(ctx, device, binary, opts)
+			if err == nil {
+				log.Println("Kernel loaded from cache", "device:", device.Name(), "path:", path)
+				return program, "", nil
+			}
+			log.Println("WARNING: cached kernel rejected, building from source", "path:", path, "err:", err)
+			os.Remove(path)
+		}
+	}
+
+	program, err := ctx.CreateProgramWithSource([]string{Kernel})
+	if err != nil {
+		return nil, "create program", err
+	}
+	began := time.Now()
+	if err = program.BuildProgram([]*cl.Device{device}, opts); err != nil {
+		program.Release()
+		return nil, "build program", err
+	}
+	log.Println("Kernel built", "device:", device.Name(), "took:", time.Since(began).Round(time.Millisecond))
+
+	if path != "" {
+		if err := saveProgram(program, path); err != nil {
+			log.Println("WARNING: kernel not cached", "path:", path, "err:", err)
+		}
+	}
+	return program, "", nil
+}
+
+// loadProgram builds the program from a cached binary.
+func loadProgram(ctx *cl.Context, device *cl.Device, binary []byte, opts string) (*cl.Program, error) {
+	program, err := ctx.CreateProgramWithBinary(device, binary)
+	if err != nil {
+		return nil, err
+	}
+	if err = program.BuildProgram([]*cl.Device{device}, opts); err != nil {
+		program.Release()
+		return nil, err
+	}
+	return program, nil
+}
+
+// saveProgram writes the binary of a program built for a single device to
+// path.
+func saveProgram(program *cl.Program, path string) error {
+	binaries, err := program.Binaries()
+	if err != nil {
+		return err
+	}
+	if len(binaries) == 0 || len(binaries[0]) == 0 {
+		return fmt.Errorf("the driver returned no binary")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, binaries[0])
+}
@@ -0,0 +1,139 @@
+package czzhash
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// RateWindows are the windows DeviceRate reports hash rates over.
+var RateWindows = [3]time.Duration{10 * time.Second, time.Minute, 15 * time.Minute}
+
+// meterSeconds is how many one second buckets a meter keeps, enough for the
+// longest of RateWindows.
+const meterSeconds = 15 * 60
+
+// meter counts the nonces of one device in one second buckets.
+type meter struct {
+	total   uint64
+	dropped uint64
+	started time.Time
+	counts  [meterSeconds]uint64
+	seconds [meterSeconds]int64 // unix second of each bucket
+}
+
+func (m *meter) add(now time.Time, n uint64) {
+	sec := now.Unix()
+	i := sec % meterSeconds
+	if m.seconds[i] != sec {
+		m.seconds[i], m.counts[i] = sec, 0
+	}
+	m.counts[i] += n
+	m.total += n
+}
+
+// rate returns the nonces per second over the window up to now, or over the
+// time since the first count if that is shorter.
+func (m *meter) rate(now time.Time, window time.Duration) float64 {
+	if since := now.Sub(m.started); since < window {
+		window = since
+	}
+	secs := int64(window / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	end := now.Unix()
+	var sum uint64
+	for i := range m.counts {
+		if s := m.seconds[i]; s > end-secs && s <= end {
+			sum += m.counts[i]
+		}
+	}
+	return float64(sum) / float64(secs)
+}
+
+// DeviceRate is the hash rate of a device.
+type DeviceRate struct {
+	Device  DeviceID
+	Total   uint64     // nonces hashed since the device started
+	Dropped uint64     // hits found but not returned, see Result.Dropped
+	Rates   [3]float64 // hashes per second over RateWindows
+}
+
+// Metrics counts the nonces hashed by each device as they are hashed and
+// turns them into hash rates over RateWindows.
+type Metrics struct {
+	mu     sync.Mutex // protects meters
+	meters map[DeviceID]*meter
+}
+
+// NewMetrics returns empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{meters: make(map[DeviceID]*meter)}
+}
+
+// Add records that device id hashed n nonces. Adding to nil Metrics does
+// nothing.
+func (m *Metrics) Add(id DeviceID, n uint64) {
+	if m == nil {
+		return
+	}
+	now := time.Now()
+	m.mu.Lock()
+	m.meter(id, now).add(now, n)
+	m.mu.Unlock()
+}
+
+// Drop records that device id found n hits it could not return. Dropping on
+// nil Metrics does nothing.
+func (m *Metrics) Drop(id DeviceID, n uint64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.meter(id, time.Now()).dropped += n
+	m.mu.Unlock()
+}
+
+// meter returns the meter of device id, started at now if it is new. mu
+// must be held.
+func (m *Metrics) meter(id DeviceID, now time.Time) *meter {
+	mt, ok := m.meters[id]
+	if !ok {
+		mt = &meter{started: now}
+		m.meters[id] = mt
+	}
+	return mt
+}
+
+// Rates returns the hash rate of every device that hashed anything, ordered
+// by device.
+func (m *Metrics) Rates() []DeviceRate {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rates := make([]DeviceRate, 0, len(m.meters))
+	for id, mt := range m.meters {
+		r := DeviceRate{Device: id, Total: mt.total, Dropped: mt.dropped}
+		for i, w := range RateWindows {
+			r.Rates[i] = mt.rate(now, w)
+		}
+		rates = append(rates, r)
+	}
+	sort.Slice(rates, func(i, j int) bool { return rates[i].Device < rates[j].Device })
+	return rates
+}
+
+// HashRate returns the hash rate of all devices together over window.
+func (m *Metrics) HashRate(window time.Duration) float64 {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sum float64
+	for _, mt := range m.meters {
+		sum += mt.rate(now, window)
+	}
+	return sum
+}
@@ -0,0 +1,19 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package czzhash
+
+import (
+	"io"
+	"os"
+)
+
+// mapTable reads the TBLSize bytes of file into a table on the heap where
+// mapping it is not supported.
+func mapTable(file *os.File) (*Csatable, error) {
+	c := NewCsatable()
+	if _, err := io.ReadFull(file, c.data); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
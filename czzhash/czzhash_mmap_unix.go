@@ -0,0 +1,23 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package czzhash
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// mapTable maps the TBLSize bytes of file read-only. The pages are shared
+// with the page cache, so every device and every process using the table
+// share one copy of it.
+func mapTable(file *os.File) (*Csatable, error) {
+	data, err := syscall.Mmap(int(file.Fd()), 0, TBLSize, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	c := &Csatable{data: data}
+	runtime.SetFinalizer(c, func(c *Csatable) { syscall.Munmap(c.data) })
+	return c, nil
+}
@@ -0,0 +1,79 @@
+//go:build nocl
+// +build nocl
+
+package czzhash
+
+import (
+	"errors"
+	"math/big"
+)
+
+// ErrNoOpenCL is returned by the OpenCL backend of a miner built with the
+// nocl tag, which builds without cgo and mines with the CPU backend only.
+var ErrNoOpenCL = errors.New("built without OpenCL (nocl tag), use the cpu backend")
+
+// OpenCLMiner stands in for the OpenCL backend, it has no devices and Init
+// fails with ErrNoOpenCL.
+type OpenCLMiner struct {
+	czzhash *CzzHash
+
+	// KernelCache is kept for the flags that set it, nothing is built
+	KernelCache string
+}
+
+// NewCL returns a backend whose Init fails with ErrNoOpenCL.
+func NewCL(configs []DeviceConfig, table TableConfig) *OpenCLMiner {
+	return &OpenCLMiner{czzhash: NewTable(table)}
+}
+
+// InitCL fails with ErrNoOpenCL.
+func InitCL(blockNum uint64, c *OpenCLMiner) error {
+	return ErrNoOpenCL
+}
+
+// Init implements Searcher.
+func (c *OpenCLMiner) Init(blockNum uint64) error {
+	return InitCL(blockNum, c)
+}
+
+// Search implements Searcher, there is no device to search on.
+func (c *OpenCLMiner) Search(hash [32]byte, target *big.Int, tbl *Csatable, nonces NonceRange, stop <-chan struct{}, id DeviceID) (*Result, error) {
+	return nil, &DeviceError{Device: id, Op: "lookup", Err: ErrUnknownDevice}
+}
+
+// Reset implements Searcher.
+func (c *OpenCLMiner) Reset(id DeviceID) error {
+	return &DeviceError{Device: id, Op: "lookup", Err: ErrUnknownDevice}
+}
+
+// Update implements Searcher.
+func (c *OpenCLMiner) Update(blockNum uint64) (*Csatable, error) {
+	return c.czzhash.GetBin(blockNum)
+}
+
+// Devices implements Searcher.
+func (c *OpenCLMiner) Devices() []DeviceID { return nil }
+
+// Metrics implements Searcher.
+func (c *OpenCLMiner) Metrics() *Metrics { return c.czzhash.Metrics }
+
+// Bin implements Searcher.
+func (c *OpenCLMiner) Bin() *Csatable { return c.czzhash.bin() }
+
+// Close implements Searcher.
+func (c *OpenCLMiner) Close() error { return nil }
+
+// Devices fails with ErrNoOpenCL.
+func Devices() ([]DeviceInfo, error) {
+	return nil, ErrNoOpenCL
+}
+
+// GetDeviceCount returns 0, there are no OpenCL devices.
+func GetDeviceCount() int {
+	return 0
+}
+
+// VerifyVectorsCL fails with ErrNoOpenCL.
+func VerifyVectorsCL() ([]DeviceVectorResult, error) {
+	return nil, ErrNoOpenCL
+}
@@ -1,113 +1,286 @@
+//go:build !nocl
+// +build !nocl
+
 package czzhash
 
 import (
-	crand "crypto/rand"
 	"fmt"
-	"github.com/Gustav-Simonsson/go-opencl/cl"
+	"github.com/classzz/miner-gpu/cl"
 	"log"
 	"math"
 	"math/big"
-	"math/rand"
+	"runtime"
+	"sort"
 	"sync"
+	"time"
 	"unsafe"
 )
 
 type OpenCLDevice struct {
-	deviceId int
+	deviceId DeviceID
 	device   *cl.Device
+	config   DeviceConfig
 	openCL11 bool // OpenCL version 1.1 and 1.2 are handled a bit different
 	openCL12 bool
 
-	binBuf       *cl.MemObject // classzz full Bin in device mem
-	headerBuf    *cl.MemObject // Hash of block-to-mine in device mem
-	searchBuffer *cl.MemObject
-
-	searchKernel *cl.Kernel
-
-	queue         *cl.CommandQueue
-	ctx           *cl.Context
-	workGroupSize int
-	result        Hash
+	binBuf     *cl.MemObject                // classzz full Bin in device mem
+	bin        *Csatable                    // the Bin in binBuf
+	headerBuf  *cl.MemObject                // Hash of block-to-mine in device mem
+	targetBuf  *cl.MemObject                // 32 byte big endian target in device mem
+	searchBufs [searchBuffers]*cl.MemObject // search_results_t of each batch in flight
+
+	// staging is pinned host memory, mapped for the life of the device,
+	// that the non-blocking reads and writes of Search go through
+	stagingBuf *cl.MemObject
+	stagingMap *cl.MappedMemObject
+	staging    []byte
+
+	// searchKernels are bound to the buffers of one batch each, so only
+	// the start nonce is set per batch
+	searchKernels [searchBuffers]*cl.Kernel
+	hashKernel    *cl.Kernel
+
+	// the job in headerBuf and targetBuf, written when Search gets another
+	hasJob    bool
+	jobHeader Hash
+	jobTarget [32]byte
+
+	queue          *cl.CommandQueue
+	ctx            *cl.Context
+	workGroupSize  int
+	globalWorkSize int // nonces hashed per dispatch
+	result         Hash
 }
 
 type OpenCLMiner struct {
 	mu sync.Mutex
 
+	// running is held for reading by every Search and Reset, Close takes
+	// it to wait for them before it releases the devices
+	running sync.RWMutex
+
 	czzhash *CzzHash // classzz full Bin & cache in host mem
 
-	deviceIds []int
-	devices   []*OpenCLDevice
+	configs []DeviceConfig
+	ids     []DeviceID // of devices, in the order of configs
+	devices map[DeviceID]*OpenCLDevice
 
-	binSize uint64
-}
+	// KernelCache is the directory compiled kernels are cached in, empty
+	// to build them from source on every start
+	KernelCache string
 
-type Result struct {
-	HashRate uint64
-	Nonce    uint64
+	binSize uint64
 }
 
 const (
 	// See [4]
 	workGroupSize = 32 // must be multiple of 8
+
+	// work items per compute unit and work group size in one dispatch
+	batchMultiplier = 8
+
+	maxOutputs    = 15 // MAX_OUTPUTS in the kernel, batches with more hits are rescanned
+	searchBufSize = 8 + 8*maxOutputs
+
+	// searchBuffers is how many batches Search keeps in flight: one is
+	// hashed while the result of the one before is read back
+	searchBuffers = 2
+
+	// layout of the staging memory: the results of each batch, the header,
+	// the target and a zero to clear the results with
+	stagingHeader = searchBuffers * searchBufSize
+	stagingTarget = stagingHeader + 32
+	stagingZero   = stagingTarget + 32
+	stagingSize   = stagingZero + 8
 )
 
-func NewCL(deviceIds []int) *OpenCLMiner {
-	ids := make([]int, len(deviceIds))
-	copy(ids, deviceIds)
+// searchResults mirrors search_results_t in the kernel.
+type searchResults struct {
+	Count  uint32
+	_      uint32
+	Nonces [maxOutputs]uint64
+}
+
+// NewCL returns an OpenCL backend for the GPUs of configs, tuned as they
+// say, that hashes with the table of table.
+func NewCL(configs []DeviceConfig, table TableConfig) *OpenCLMiner {
+	cfgs := make([]DeviceConfig, len(configs))
+	copy(cfgs, configs)
 	return &OpenCLMiner{
-		czzhash:   New(),
-		binSize:   TBLSize, // to see if we need to update Bin.
-		deviceIds: ids,
+		czzhash:     NewTable(table),
+		KernelCache: DefaultKernelCache(),
+		binSize:     TBLSize, // to see if we need to update Bin.
+		configs:     cfgs,
+		devices:     make(map[DeviceID]*OpenCLDevice),
 	}
 }
 
 // See [2]. We basically do the same here, but the Go OpenCL bindings
 // are at a slightly higher abtraction level.
+// A device that fails to initialise is left out, InitCL only fails when no
+// device is left.
 func InitCL(blockNum uint64, c *OpenCLMiner) error {
-	platforms, err := cl.GetPlatforms()
+	registry, err := NewRegistry()
 	if err != nil {
-		return fmt.Errorf("Plaform error: %v\nCheck your OpenCL installation and then run geth gpuinfo", err)
+		return err
 	}
 
-	var devices []*cl.Device
-	for _, p := range platforms {
-		ds, err := cl.GetDevices(p, cl.DeviceTypeGPU)
-		if err != nil {
-			return fmt.Errorf("Devices error: %v\nCheck your GPU drivers and then run geth gpuinfo", err)
-		}
-		for _, d := range ds {
-			devices = append(devices, d)
-		}
+	if _, err := c.czzhash.GetBin(blockNum); err != nil {
+		return err
 	}
 
-	pow := New()
-	pow.Csatable = pow.GetBin(blockNum) // generates Bin if we don't have it
-	c.czzhash = pow
-
-	for _, id := range c.deviceIds {
-		fmt.Printf("Device (%s): %s", devices[id].Type(), devices[id].Name())
-		if id > len(devices)-1 {
-			return fmt.Errorf("Device id not found. See available device ids with: geth gpuinfo")
-		} else {
-			err := initCLDevice(id, devices[id], c)
-			fmt.Println("err:", err)
-			if err != nil {
-				return err
+	var firstErr error
+	for _, cfg := range c.configs {
+		device, ok := registry.Lookup(cfg.ID)
+		if !ok {
+			return fmt.Errorf("Device %s not found. See available devices with: miner-gpu list-devices", cfg.ID)
+		}
+		log.Println("Device", "id:", cfg.ID, "type:", device.Type(), "name:", device.Name())
+		if err := initCLDevice(cfg, device, c); err != nil {
+			log.Println("Device init failed", "device:", cfg.ID, "err:", err)
+			if firstErr == nil {
+				firstErr = err
 			}
 		}
 	}
 	if len(c.devices) == 0 {
+		if firstErr != nil {
+			return firstErr
+		}
 		return fmt.Errorf("No GPU devices found")
 	}
 	return nil
 }
 
-func initCLDevice(deviceId int, device *cl.Device, c *OpenCLMiner) error {
+// Init implements Searcher.
+func (c *OpenCLMiner) Init(blockNum uint64) error {
+	return InitCL(blockNum, c)
+}
+
+// Bin implements Searcher.
+func (c *OpenCLMiner) Bin() *Csatable {
+	return c.czzhash.bin()
+}
+
+// Update implements Searcher. Each device uploads the Bin at the start of
+// the first Search with it.
+func (c *OpenCLMiner) Update(blockNum uint64) (*Csatable, error) {
+	return c.czzhash.GetBin(blockNum)
+}
+
+// Close implements Searcher and releases the OpenCL objects of every device
+// once the Searches and Resets running on them are done.
+func (c *OpenCLMiner) Close() error {
+	c.running.Lock()
+	defer c.running.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, d := range c.devices {
+		d.release()
+	}
+	c.ids, c.devices = nil, make(map[DeviceID]*OpenCLDevice)
+	return nil
+}
+
+// Reset implements Searcher. The OpenCL objects of the device are released
+// and created anew, with the Bin uploaded again.
+func (c *OpenCLMiner) Reset(id DeviceID) error {
+	c.running.RLock()
+	defer c.running.RUnlock()
+	d, err := c.device(id)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Resetting device", d.deviceId, d.device.Name())
+	d.release()
+	nd, err := newCLDevice(d.config, d.device, c)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.devices[id] = nd
+	c.mu.Unlock()
+	return nil
+}
+
+// device looks up the device id.
+func (c *OpenCLMiner) device(id DeviceID) (*OpenCLDevice, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.devices[id]
+	if !ok {
+		return nil, &DeviceError{Device: id, Op: "lookup", Err: ErrUnknownDevice}
+	}
+	return d, nil
+}
+
+// release releases the OpenCL objects the device holds.
+func (d *OpenCLDevice) release() {
+	for _, k := range d.searchKernels {
+		if k != nil {
+			k.Release()
+		}
+	}
+	if d.hashKernel != nil {
+		d.hashKernel.Release()
+	}
+	if d.stagingMap != nil {
+		if err := released(d.queue.EnqueueUnmapMemObject(d.stagingBuf, d.stagingMap, nil)); err == nil {
+			d.queue.Finish()
+		}
+	}
+	if d.stagingBuf != nil {
+		d.stagingBuf.Release()
+	}
+	for _, buf := range d.searchBufs {
+		if buf != nil {
+			buf.Release()
+		}
+	}
+	if d.headerBuf != nil {
+		d.headerBuf.Release()
+	}
+	if d.targetBuf != nil {
+		d.targetBuf.Release()
+	}
+	if d.binBuf != nil {
+		d.binBuf.Release()
+	}
+	if d.queue != nil {
+		d.queue.Release()
+	}
+	if d.ctx != nil {
+		d.ctx.Release()
+	}
+	*d = OpenCLDevice{deviceId: d.deviceId, device: d.device, config: d.config}
+}
+
+func initCLDevice(cfg DeviceConfig, device *cl.Device, c *OpenCLMiner) error {
+	d, err := newCLDevice(cfg, device, c)
+	if err != nil {
+		return err
+	}
+	c.ids = append(c.ids, cfg.ID)
+	c.devices[cfg.ID] = d
+	return nil
+}
+
+// newCLDevice builds the kernel for device, tunes it by cfg and uploads the
+// Bin. Errors are *DeviceError, whatever was created up to the failure is
+// released.
+func newCLDevice(cfg DeviceConfig, device *cl.Device, c *OpenCLMiner) (*OpenCLDevice, error) {
+	deviceId := cfg.ID
 	devMaxAlloc := uint64(device.MaxMemAllocSize())
 	devGlobalMem := uint64(device.GlobalMemSize())
 
 	if device.Version() == "OpenCL 1.0" {
-		return fmt.Errorf("opencl version not supported %s", device.Version())
+		return nil, &DeviceError{Device: deviceId, Op: "init", Err: fmt.Errorf("opencl version not supported %s", device.Version())}
+	}
+	if err := cfg.check(device); err != nil {
+		return nil, &DeviceError{Device: deviceId, Op: "tune", Err: err}
 	}
 	var cl11, cl12 bool
 	if device.Version() == "OpenCL 1.1" {
@@ -127,22 +300,32 @@ func initCLDevice(deviceId int, device *cl.Device, c *OpenCLMiner) error {
 		fmt.Printf("You probably have to export GPU_MAX_ALLOC_PERCENT=95\n")
 	}
 
-	log.Println("Initialising device", deviceId, device.Name())
-	context, err := cl.CreateContext([]*cl.Device{device})
-	if err != nil {
-		return fmt.Errorf("failed creating context: %v", err)
+	// (context.go) to work with uint64 as size_t
+	if c.binSize > math.MaxInt32 {
+		return nil, &DeviceError{Device: deviceId, Op: "init", Kind: ErrOutOfResources, Err: fmt.Errorf("Bin too large for alloc")}
 	}
 
-	queue, err := context.CreateCommandQueue(device, 0)
-	if err != nil {
-		return fmt.Errorf("command queue err: %v", err)
+	d := &OpenCLDevice{
+		deviceId: deviceId,
+		device:   device,
+		config:   cfg,
+		openCL11: cl11,
+		openCL12: cl12,
+	}
+	fail := func(op string, err error) (*OpenCLDevice, error) {
+		d.release()
+		return nil, deviceError(deviceId, op, err)
 	}
 
-	// See [4] section 3.2 and [3] "clBuildProgram".
-	// The OpenCL kernel code is compiled at run-time.
-	program, err := context.CreateProgramWithSource([]string{Kernel})
-	if err != nil {
-		return fmt.Errorf("program err: %v", err)
+	log.Println("Initialising device", deviceId, device.Name())
+	var err error
+	if d.ctx, err = cl.CreateContext([]*cl.Device{device}); err != nil {
+		return fail("create context", err)
+	}
+
+	// profiling gives the time the kernels ran on the device, see kernelTime
+	if d.queue, err = d.ctx.CreateCommandQueue(device, cl.CommandQueueProfilingEnable); err != nil {
+		return fail("create command queue", err)
 	}
 
 	/* if using AMD OpenCL impl, you can set this to debug on x86 CPU device.
@@ -156,185 +339,461 @@ func initCLDevice(deviceId int, device *cl.Device, c *OpenCLMiner) error {
 
 	*/
 	buildOpts := ""
-	err = program.BuildProgram([]*cl.Device{device}, buildOpts)
+
+	// See [4] section 3.2 and [3] "clBuildProgram".
+	// The OpenCL kernel code is compiled at run-time, or loaded from the
+	// binary cached by an earlier start.
+	program, op, err := buildProgram(d.ctx, device, c.KernelCache, buildOpts)
 	if err != nil {
-		return fmt.Errorf("program build err: %v", err)
+		d.release()
+		return nil, buildError(deviceId, op, err)
 	}
+	defer program.Release()
 
 	var searchKernelName string
 	searchKernelName = "czzhash_search"
 
-	searchKernel, err := program.CreateKernel(searchKernelName)
-	if err != nil {
-		return fmt.Errorf("kernel err: %v", err)
+	for i := range d.searchKernels {
+		if d.searchKernels[i], err = program.CreateKernel(searchKernelName); err != nil {
+			d.release()
+			return nil, buildError(deviceId, "create kernel "+searchKernelName, err)
+		}
 	}
 
-	// (context.go) to work with uint64 as size_t
-	if c.binSize > math.MaxInt32 {
-		fmt.Println("Bin too large for allocation.")
-		return fmt.Errorf("Bin too large for alloc")
+	if d.hashKernel, err = program.CreateKernel("czzhash_hash"); err != nil {
+		d.release()
+		return nil, buildError(deviceId, "create kernel czzhash_hash", err)
 	}
 
-	binBuf, err := context.CreateEmptyBuffer(cl.MemReadOnly, TBLSize)
-	if err != nil {
-		return fmt.Errorf("allocating Bin buf failed: %v", err)
+	// the driver may not run workGroupSize items per group with this kernel
+	groupSize := workGroupSize
+	max, err := d.searchKernels[0].WorkGroupSize(device)
+	if cfg.WorkGroupSize != 0 {
+		groupSize = cfg.WorkGroupSize
+		if err == nil && max < groupSize {
+			d.release()
+			return nil, &DeviceError{Device: deviceId, Op: "tune", Err: fmt.Errorf("work group size %d exceeds the kernel maximum of %d", groupSize, max)}
+		}
+	} else if err == nil && max < groupSize {
+		groupSize = max
+	}
+	batch := batchMultiplier
+	if cfg.BatchMultiplier != 0 {
+		batch = cfg.BatchMultiplier
+	}
+	d.workGroupSize = groupSize
+	d.globalWorkSize = device.MaxComputeUnits() * groupSize * batch
+	if cfg.Intensity != 0 {
+		d.globalWorkSize = 1 << uint(cfg.Intensity)
+	}
+	if d.globalWorkSize%groupSize != 0 || d.globalWorkSize > math.MaxInt32 {
+		d.release()
+		return nil, &DeviceError{Device: deviceId, Op: "tune", Err: fmt.Errorf("%d work items do not split into groups of %d", d.globalWorkSize, groupSize)}
 	}
+	log.Println("Device tuned", "device:", deviceId, "worksize:", groupSize, "global:", d.globalWorkSize)
 
-	searchBuffer, err := context.CreateEmptyBuffer(cl.MemWriteOnly, 32)
-	if err != nil {
-		return fmt.Errorf("allocating Bin buf failed: %v", err)
+	for i := range d.searchBufs {
+		if d.searchBufs[i], err = d.ctx.CreateEmptyBuffer(cl.MemWriteOnly, searchBufSize); err != nil {
+			return fail("allocating search buf", err)
+		}
 	}
 
-	//write Bin to device mem
-	csa := c.czzhash.Full.Csatable.Bytes()
-	csatable := [TBLSize]byte{}
-	for i, j := range csa {
-		csatable[i] = j
+	if d.headerBuf, err = d.ctx.CreateEmptyBuffer(cl.MemReadOnly, 32); err != nil {
+		return fail("allocating header buf", err)
 	}
 
-	_, err = queue.EnqueueWriteBuffer(binBuf, true, 0, TBLSize, unsafe.Pointer(&csatable), nil)
-	if err != nil {
+	if d.targetBuf, err = d.ctx.CreateEmptyBuffer(cl.MemReadOnly, 32); err != nil {
+		return fail("allocating target buf", err)
 	}
 
-	deviceStruct := &OpenCLDevice{
-		deviceId: deviceId,
-		device:   device,
-		openCL11: cl11,
-		openCL12: cl12,
+	// pinned by the driver, so transfers from and to it need not block
+	if d.stagingBuf, err = d.ctx.CreateEmptyBuffer(cl.MemReadWrite|cl.MemAllocHostPtr, stagingSize); err != nil {
+		return fail("allocating staging buf", err)
+	}
+	var mapped *cl.Event
+	if d.stagingMap, mapped, err = d.queue.EnqueueMapBuffer(d.stagingBuf, true, cl.MapFlagRead|cl.MapFlagWrite, 0, stagingSize, nil); err != nil {
+		return fail("mapping staging buf", err)
+	}
+	mapped.Release()
+	d.staging = d.stagingMap.ByteSlice()
+	for i := range d.staging {
+		d.staging[i] = 0
+	}
 
-		binBuf:       binBuf,
-		searchBuffer: searchBuffer,
+	if op, err := d.setBin(c.czzhash.bin()); err != nil {
+		return fail(op, err)
+	}
 
-		searchKernel: searchKernel,
+	// bound for the life of the device, Search only sets the start nonce
+	// and setBin the Bin
+	isolate := uint32(0xFFFFFFFF)
+	for i, k := range d.searchKernels {
+		if err = k.SetArgs(d.searchBufs[i], d.headerBuf, d.binBuf, uint64(0), d.targetBuf, isolate); err != nil {
+			return fail("clSetKernelArg", err)
+		}
+	}
 
-		queue: queue,
-		ctx:   context,
+	return d, nil
+}
 
-		workGroupSize: workGroupSize,
+// setBin uploads tbl into a new Bin buffer and releases the old one once
+// the new one is in place.
+func (d *OpenCLDevice) setBin(tbl *Csatable) (string, error) {
+	binBuf, err := d.ctx.CreateEmptyBuffer(cl.MemReadOnly, TBLSize)
+	if err != nil {
+		return "allocating Bin buf", err
 	}
-	c.devices = append(c.devices, deviceStruct)
 
-	return nil
+	// write Bin to device mem straight from the table, which is mapped
+	// from the table file when loaded with LoadTable
+	err = released(d.queue.EnqueueWriteBuffer(binBuf, true, 0, TBLSize, unsafe.Pointer(&tbl.Bytes()[0]), nil))
+	runtime.KeepAlive(tbl)
+	if err != nil {
+		binBuf.Release()
+		return "writing Bin", err
+	}
+
+	for _, k := range d.searchKernels {
+		if k == nil {
+			continue
+		}
+		if err = k.SetArg(2, binBuf); err != nil {
+			binBuf.Release()
+			return "clSetKernelArg", err
+		}
+	}
+
+	if d.binBuf != nil {
+		d.binBuf.Release()
+	}
+	d.binBuf, d.bin = binBuf, tbl
+	return "", nil
 }
 
-func (c *OpenCLMiner) Search(hash [32]byte, target uint64, stop <-chan struct{}, index int64) *Result {
+// batch is a dispatch of the search kernel whose results are being read
+// back into slot of the staging memory.
+type batch struct {
+	slot   int
+	start  uint64 // first nonce of the range it hashes
+	count  uint64 // nonces of the range it hashes
+	kernel *cl.Event
+	read   *cl.Event
+}
 
-	headerHash := hash
-	log.Println("Search", "index:", index, "hash:", hash, "target:", target)
+// release releases the events of b.
+func (b batch) release() {
+	b.kernel.Release()
+	b.read.Release()
+}
 
-	d := c.devices[index]
-	headerBuf, err := d.ctx.CreateEmptyBuffer(cl.MemReadOnly, 32)
-	_, err = d.queue.EnqueueWriteBuffer(headerBuf, true, 0, 32, unsafe.Pointer(&headerHash), nil)
+// kernelTime returns how long the kernel of a finished batch ran on the
+// device, 0 if the driver has no profiling info for it.
+func (b batch) kernelTime() time.Duration {
+	start, err := b.kernel.GetEventProfilingInfo(cl.ProfilingInfoCommandStart)
 	if err != nil {
-		log.Fatal("Error in Search clEnqueueWriterBuffer", "err", err)
-		return nil
+		return 0
+	}
+	end, err := b.kernel.GetEventProfilingInfo(cl.ProfilingInfoCommandEnd)
+	if err != nil || end < start {
+		return 0
 	}
+	return time.Duration(end - start)
+}
 
-	defer d.queue.Flush()
+// Search keeps searchBuffers batches in flight: while the device hashes one
+// the result of the one before is read back and the next one is queued, so
+// the device does not wait for the host between batches.
+func (c *OpenCLMiner) Search(hash [32]byte, target *big.Int, tbl *Csatable, nonces NonceRange, stop <-chan struct{}, id DeviceID) (*Result, error) {
+	c.running.RLock()
+	defer c.running.RUnlock()
+	d, err := c.device(id)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(op string, err error) (*Result, error) {
+		return nil, deviceError(d.deviceId, op, err)
+	}
 
-	// we grab a single random nonce and sets this as argument to the kernel search function
-	// the device will then add each local threads gid to the nonce, creating a unique nonce
-	// for each device computing unit executing in parallel
-	seed, _ := crand.Int(crand.Reader, big.NewInt(math.MaxInt64))
-	InitNonce := rand.New(rand.NewSource(seed.Int64())).Uint64()
-	Nonce := InitNonce
+	// work of another epoch, see Update
+	if tbl != d.bin {
+		log.Println("Switching Bin", "device:", d.deviceId)
+		if op, err := d.setBin(tbl); err != nil {
+			return fail(op, err)
+		}
+	}
 
-	for {
-		select {
-		case <-stop:
-			su := &Result{
-				HashRate: Nonce - InitNonce,
-			}
-			return su
-		default:
-			err = d.searchKernel.SetArg(1, headerBuf)
-			if err != nil {
-				log.Fatal("Error in Search clSetKernelArg ", "err", err)
-				return nil
-			}
+	// a new job is staged, the in-order queue writes it once the batches
+	// of the last Search are done without the host waiting
+	targetBytes := TargetBytes(target)
+	if !d.hasJob || d.jobHeader != hash || d.jobTarget != targetBytes {
+		copy(d.staging[stagingHeader:], hash[:])
+		copy(d.staging[stagingTarget:], targetBytes[:])
+		if err = released(d.queue.EnqueueWriteBuffer(d.headerBuf, false, 0, 32, d.staged(stagingHeader), nil)); err != nil {
+			return fail("clEnqueueWriteBuffer header", err)
+		}
+		if err = released(d.queue.EnqueueWriteBuffer(d.targetBuf, false, 0, 32, d.staged(stagingTarget), nil)); err != nil {
+			return fail("clEnqueueWriteBuffer target", err)
+		}
+		d.hasJob, d.jobHeader, d.jobTarget = true, hash, targetBytes
+	}
+	for slot := range d.searchBufs {
+		if err = d.clearResults(slot); err != nil {
+			return fail("clEnqueueWriteBuffer results", err)
+		}
+	}
 
-			err = d.searchKernel.SetArg(2, d.binBuf)
-			if err != nil {
-				log.Fatal("Error in Search clSetKernelArg ", "err", err)
-				return nil
-			}
+	// the range start is set as argument to the kernel search function,
+	// the device will then add each global thread's gid to the nonce,
+	// creating a unique nonce for each device computing unit executing in
+	// parallel
+	Nonce := nonces.Start
+	var (
+		dispatched uint64 // nonces queued
+		hashed     uint64 // nonces whose results were read
+		inflight   []batch
+		slot       int
+		stopped    bool
+		found      []uint64
+		dropped    uint64        // hits of single work groups past maxOutputs
+		overflowed []NonceRange  // batches with more hits than maxOutputs
+		kernel     time.Duration // the batches read ran on the device
+	)
+	// batches still in flight are waited for however Search ends, the
+	// staging memory is reused by the next one
+	defer func() {
+		for _, b := range inflight {
+			cl.WaitForEvents([]*cl.Event{b.read})
+			b.release()
+		}
+	}()
 
-			err = d.searchKernel.SetArg(4, target)
-			if err != nil {
-				log.Fatal("Error in Search clSetKernelArg ", "err", err)
-				return nil
+	for {
+		// keep the device fed until something is found, the batches in
+		// flight are still read so that none of their nonces is lost
+		for len(inflight) < searchBuffers && dispatched < nonces.Count && !stopped && len(found) == 0 && len(overflowed) == 0 {
+			select {
+			case <-stop:
+				stopped = true
+				continue
+			default:
 			}
 
-			isolate := uint32(0xFFFFFFFF)
-			err = d.searchKernel.SetArg(5, isolate)
+			err = d.searchKernels[slot].SetArg(3, Nonce)
 			if err != nil {
-				log.Fatal("Error in Search clSetKernelArg ", "err", err)
-				return nil
+				return fail("clSetKernelArg", err)
 			}
 
-			err = d.searchKernel.SetArg(0, d.searchBuffer)
-			if err != nil {
-				log.Fatal("Error in Search clSetKernelArg ", "err", err)
-				return nil
-			}
-			err = d.searchKernel.SetArg(3, Nonce)
-			if err != nil {
-				log.Fatal("Error in Search clSetKernelArg ", "err", err)
-				return nil
+			// the last batch of the range shrinks to the work groups covering
+			// what is left, nonces past the range are dropped below
+			globalWorkSize, count := d.globalWorkSize, uint64(d.globalWorkSize)
+			if left := nonces.Count - dispatched; left < count {
+				group := uint64(d.workGroupSize)
+				globalWorkSize, count = int((left+group-1)/group*group), left
 			}
 
-			// execute kernel
-			_, err = d.queue.EnqueueNDRangeKernel(
-				d.searchKernel,
+			kernelEvent, err := d.queue.EnqueueNDRangeKernel(
+				d.searchKernels[slot],
 				nil,
-				[]int{1},
-				[]int{1},
+				[]int{globalWorkSize},
+				[]int{d.workGroupSize},
 				nil)
 
 			if err != nil {
-				log.Fatal("Error in Search clEnqueueNDRangeKernel ", "err", err)
-				return nil
+				return fail("clEnqueueNDRangeKernel", err)
 			}
 
-			var result [32]byte
-			_, err = d.queue.EnqueueReadBuffer(d.searchBuffer, true, 0, 32, unsafe.Pointer(&result), nil)
+			read, err := d.queue.EnqueueReadBuffer(d.searchBufs[slot], false, 0, searchBufSize, d.staged(slot*searchBufSize), nil)
 			if err != nil {
-				log.Fatal("Error in Search clEnqueueMapBuffer ", "err", err)
-				return nil
+				kernelEvent.Release()
+				return fail("clEnqueueReadBuffer", err)
 			}
-			//log.Println("index",index,"result ",result)
-			if new(big.Int).SetBytes(result[:]).Cmp(big.NewInt(0).SetUint64(target)) <= 0 {
-				su := &Result{
-					HashRate: Nonce - InitNonce,
-					Nonce:    Nonce,
-				}
-				return su
+			inflight = append(inflight, batch{slot: slot, start: Nonce, count: count, kernel: kernelEvent, read: read})
+			if err = d.queue.Flush(); err != nil {
+				return fail("clFlush", err)
 			}
+			Nonce += count
+			dispatched += count
+			slot = (slot + 1) % searchBuffers
+		}
+		if len(inflight) == 0 {
+			break
+		}
+
+		// the oldest batch is done once its results are read
+		b := inflight[0]
+		if err = cl.WaitForEvents([]*cl.Event{b.read}); err != nil {
+			return fail("clWaitForEvents", err)
+		}
+		// the queue is in order, the kernel finished before the read
+		kernel += b.kernelTime()
+		b.release()
+		inflight = inflight[1:]
+		hashed += b.count
+		c.czzhash.Metrics.Add(id, b.count)
+
+		results := (*searchResults)(d.staged(b.slot * searchBufSize))
+		if results.Count == 0 {
+			continue
+		}
+		if results.Count > maxOutputs && b.count > uint64(d.workGroupSize) {
+			// the kernel counted hits it had no room for, the batch is
+			// searched again in parts once the ones in flight are read
+			overflowed = append(overflowed, NonceRange{Start: b.start, Count: b.count})
+		} else {
+			if results.Count > maxOutputs {
+				dropped += uint64(results.Count - maxOutputs)
+			}
+			found = append(found, d.hits(results, NonceRange{Start: b.start, Count: b.count})...)
+		}
+		if err = d.clearResults(b.slot); err != nil {
+			return fail("clEnqueueWriteBuffer results", err)
 		}
-		Nonce++
 	}
-}
 
-func (c *OpenCLMiner) GetDeviceCount() int {
-	return len(c.devices)
+	su := &Result{
+		Nonces:     hashed,
+		Found:      found,
+		Dropped:    dropped,
+		KernelTime: kernel,
+	}
+	for _, r := range overflowed {
+		if op, err := d.rescan(r, su); err != nil {
+			return fail(op, err)
+		}
+	}
+	if su.Dropped > 0 {
+		c.czzhash.Metrics.Drop(id, su.Dropped)
+	}
+	// the work items of a batch store their hits in any order
+	sort.Slice(su.Found, func(i, j int) bool {
+		return su.Found[i]-nonces.Start < su.Found[j]-nonces.Start
+	})
+	return su, nil
 }
 
-func GetDeviceCount() int {
-
-	platforms, err := cl.GetPlatforms()
-	if err != nil {
-		return 0
+// hits returns the nonces of r among the results of a batch.
+func (d *OpenCLDevice) hits(results *searchResults, r NonceRange) []uint64 {
+	n := int(results.Count)
+	if n > maxOutputs {
+		n = maxOutputs
+	}
+	var hits []uint64
+	for _, nonce := range results.Nonces[:n] {
+		// the last work group of a batch may run past its range
+		if r.Contains(nonce) {
+			hits = append(hits, nonce)
+		}
 	}
-	count := 0
-	for _, p := range platforms {
-		ds, err := cl.GetDevices(p, cl.DeviceTypeGPU)
+	return hits
+}
+
+// rescan searches r, a batch with more hits than its results hold, again in
+// two parts of whole work groups, and the parts that still overflow in turn,
+// adding their hits to su. The hits past maxOutputs of a single work group
+// cannot be returned, they are counted in su.Dropped.
+func (d *OpenCLDevice) rescan(r NonceRange, su *Result) (string, error) {
+	group := uint64(d.workGroupSize)
+	half := (r.Count/2 + group - 1) / group * group
+	for _, part := range []NonceRange{{Start: r.Start, Count: half}, {Start: r.Start + half, Count: r.Count - half}} {
+		results, op, err := d.searchPart(part, su)
 		if err != nil {
-			return 0
+			return op, err
 		}
-		for _, d := range ds {
-			d.Name()
-			count++
+		if results.Count > maxOutputs && part.Count > group {
+			if op, err := d.rescan(part, su); err != nil {
+				return op, err
+			}
+			continue
+		}
+		if results.Count > maxOutputs {
+			su.Dropped += uint64(results.Count - maxOutputs)
 		}
+		su.Found = append(su.Found, d.hits(results, part)...)
+	}
+	return "", nil
+}
+
+// searchPart runs the search kernel of slot 0 over r, which is at most a
+// batch, and waits for its results. Nothing else may be in flight.
+func (d *OpenCLDevice) searchPart(r NonceRange, su *Result) (*searchResults, string, error) {
+	if err := d.clearResults(0); err != nil {
+		return nil, "clEnqueueWriteBuffer results", err
+	}
+	if err := d.searchKernels[0].SetArg(3, r.Start); err != nil {
+		return nil, "clSetKernelArg", err
+	}
+	group := uint64(d.workGroupSize)
+	kernelEvent, err := d.queue.EnqueueNDRangeKernel(d.searchKernels[0], nil,
+		[]int{int((r.Count + group - 1) / group * group)}, []int{d.workGroupSize}, nil)
+	if err != nil {
+		return nil, "clEnqueueNDRangeKernel", err
+	}
+	read, err := d.queue.EnqueueReadBuffer(d.searchBufs[0], true, 0, searchBufSize, d.staged(0), nil)
+	if err != nil {
+		kernelEvent.Release()
+		return nil, "clEnqueueReadBuffer", err
+	}
+	b := batch{kernel: kernelEvent, read: read}
+	su.KernelTime += b.kernelTime()
+	b.release()
+	return (*searchResults)(d.staged(0)), "", nil
+}
+
+// staged returns a pointer to offset of the staging memory.
+func (d *OpenCLDevice) staged(offset int) unsafe.Pointer {
+	return unsafe.Pointer(&d.staging[offset])
+}
+
+// clearResults resets the match counter of result buffer slot. The zero
+// comes from the staging memory, so the write does not block.
+func (d *OpenCLDevice) clearResults(slot int) error {
+	return released(d.queue.EnqueueWriteBuffer(d.searchBufs[slot], false, 0, 4, d.staged(stagingZero), nil))
+}
+
+// deviceError wraps err from op on device and classifies it.
+func deviceError(device DeviceID, op string, err error) error {
+	e := &DeviceError{Device: device, Op: op, Err: err}
+	switch err {
+	case cl.ErrOutOfResources, cl.ErrOutOfHostMemory, cl.ErrMemObjectAllocationFailure:
+		e.Kind = ErrOutOfResources
+	case cl.ErrBuildProgramFailure, cl.ErrCompilerNotAvailable, cl.ErrInvalidProgramExecutable:
+		e.Kind = ErrBuildFailure
+	default:
+		// anything else failing on a working context means the driver
+		// has given up on the device
+		e.Kind = ErrDeviceLost
+	}
+	return e
+}
+
+// released releases the event of a command nothing waits for and passes on
+// the error of enqueueing it.
+func released(ev *cl.Event, err error) error {
+	if ev != nil {
+		ev.Release()
+	}
+	return err
+}
+
+// Metrics implements Searcher.
+func (c *OpenCLMiner) Metrics() *Metrics {
+	return c.czzhash.Metrics
+}
+
+// Devices implements Searcher.
+func (c *OpenCLMiner) Devices() []DeviceID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := make([]DeviceID, len(c.ids))
+	copy(ids, c.ids)
+	return ids
+}
+
+// GetDeviceCount returns the number of GPUs of all platforms.
+func GetDeviceCount() int {
+	gs, err := gpus()
+	if err != nil {
+		return 0
 	}
-	return count
+	return len(gs)
 }
@@ -5,6 +5,7 @@ const Kernel = `#define		PK_SIZE					32
 #define		CZA_DATA_SIZE			8
 #define		CZA_KEYSBUFF_SIZE		56
 #define		CZA_CWBITS_SIZE			64
+#define		MAX_OUTPUTS			15
 
 typedef		uchar				cza_cw_t[8];
 typedef		uchar			cza_block_t[CZA_DATA_SIZE];
@@ -928,7 +929,7 @@ int czz_scramble(
 }
 
 void compute_hash_chunks(
-	__global volatile uchar* restrict g_output,
+	uchar* restrict hash_out,
 	__constant uchar const* g_header,
 	__global uchar const* g_dag,
 	ulong nonce,
@@ -985,25 +986,62 @@ void compute_hash_chunks(
 	barrier(CLK_LOCAL_MEM_FENCE);
 	byteCpy(perm_in, perm_out);
 	sha3(perm_out, 256, output, 32);
-	copy_s(g_output, output, 32);
+	copy_s(hash_out, output, 32);
+}
+
+// search_results_t is the output buffer of czzhash_search. The host clears
+// count, every matching work item bumps it and stores its nonce if there is
+// room. count goes on past MAX_OUTPUTS, so the host sees the hits it lost.
+typedef struct {
+	uint count;
+	uint pad;
+	ulong nonces[MAX_OUTPUTS];
+} search_results_t;
+
+// hash_le_target compares the hash written by compute_hash_chunks, which is
+// big endian, with the big endian target on all 256 bits.
+int hash_le_target(uchar const* hash, __constant uchar const* target)
+{
+	for (int i = 0; i < 32; i++)
+	{
+		if (hash[i] != target[i])
+			return hash[i] < target[i];
+	}
+	return 1;
 }
 
 __kernel void czzhash_search(
-	__global volatile uchar* restrict g_output,
+	__global volatile search_results_t* restrict g_output,
 	__constant uchar const* g_header,
 	__global uchar const* g_dag,
 	ulong start_nonce,
-	ulong target,
+	__constant uchar const* g_target,
 	uint isolate
 	)
 {
-	//__local compute_hash_share share[HASHES_PER_LOOP];
 	uint const gid = get_global_id(0);
-	compute_hash_chunks(g_output, g_header, g_dag, start_nonce + 0, 1);
-	//if (as_ulong(as_uchar8(g_output[0]).s76543210) < target)
-	//{
-		//uint slot = min(convert_uint(MAX_OUTPUTS), convert_uint(atomic_inc(&g_output[0]) + 1));
-		//g_output[slot] = gid;
-	//}
+	uchar hash[32];
+
+	compute_hash_chunks(hash, g_header, g_dag, start_nonce + gid, isolate);
+	if (hash_le_target(hash, g_target))
+	{
+		uint slot = atomic_inc(&g_output->count);
+		if (slot < MAX_OUTPUTS)
+			g_output->nonces[slot] = start_nonce + gid;
+	}
+}
+
+// czzhash_hash writes the hash of a single nonce, for conformance checks.
+__kernel void czzhash_hash(
+	__global uchar* restrict g_output,
+	__constant uchar const* g_header,
+	__global uchar const* g_dag,
+	ulong nonce
+	)
+{
+	uchar hash[32];
+
+	compute_hash_chunks(hash, g_header, g_dag, nonce, 1);
+	copy(g_output, hash, 32);
 }
 `
@@ -0,0 +1,140 @@
+//go:build !nocl
+// +build !nocl
+
+package czzhash
+
+import (
+	"fmt"
+	"math/big"
+	"unsafe"
+
+	"github.com/classzz/miner-gpu/cl"
+)
+
+// VerifyVectorsCL runs the vectors through the OpenCL kernel on every device
+// of every platform, CPU devices such as POCL included, so that the kernel can
+// be checked on machines without a GPU.
+func VerifyVectorsCL() ([]DeviceVectorResult, error) {
+	platforms, err := cl.GetPlatforms()
+	if err != nil {
+		return nil, fmt.Errorf("Plaform error: %v\nCheck your OpenCL installation", err)
+	}
+
+	var results []DeviceVectorResult
+	for pi, p := range platforms {
+		ds, err := cl.GetDevices(p, cl.DeviceTypeAll)
+		if err != nil {
+			return results, fmt.Errorf("Devices error: %v", err)
+		}
+		for i, device := range ds {
+			res := DeviceVectorResult{Device: fmt.Sprintf("%s: %s (%s)", p.Name(), device.Name(), device.Type())}
+			res.Checked, res.Err = verifyDevice(deviceID(pi, i, ""), device)
+			results = append(results, res)
+		}
+	}
+	return results, nil
+}
+
+// verifyDevice initialises device once per table seed and runs each vector
+// through czzhash_search and czzhash_hash with a single work item.
+func verifyDevice(id DeviceID, device *cl.Device) (int, error) {
+	var (
+		tbl *Csatable
+		c   *OpenCLMiner
+	)
+	defer func() {
+		if c != nil {
+			c.Close()
+		}
+	}()
+	return VerifyVectors(func(v *Vector, t *Csatable) (Hash, error) {
+		if t != tbl {
+			if c != nil {
+				c.Close()
+			}
+			tbl = t
+			c = &OpenCLMiner{czzhash: &CzzHash{&Full{Csatable: t}}, binSize: TBLSize, devices: make(map[DeviceID]*OpenCLDevice)}
+			if err := initCLDevice(DeviceConfig{ID: id}, device, c); err != nil {
+				return Hash{}, err
+			}
+		}
+		header, _ := decodeHash(v.Header)
+		result, _ := decodeHash(v.Result)
+
+		// the search kernel has to accept the nonce at exactly its own hash
+		d := c.devices[id]
+		found, err := d.searchOne(header, v.Nonce, HashToBig(result))
+		if err != nil {
+			return Hash{}, err
+		}
+		if !found {
+			return Hash{}, fmt.Errorf("czzhash_search rejected nonce %#x", v.Nonce)
+		}
+		return d.hashOne(header, v.Nonce)
+	})
+}
+
+// searchOne runs czzhash_search with a single work item and reports whether
+// nonce was found for target.
+func (d *OpenCLDevice) searchOne(header Hash, nonce uint64, target *big.Int) (bool, error) {
+	// the job Search wrote is overwritten
+	d.hasJob = false
+	targetBytes := TargetBytes(target)
+	if err := released(d.queue.EnqueueWriteBuffer(d.headerBuf, true, 0, 32, unsafe.Pointer(&header), nil)); err != nil {
+		return false, err
+	}
+	if err := released(d.queue.EnqueueWriteBuffer(d.targetBuf, true, 0, 32, unsafe.Pointer(&targetBytes), nil)); err != nil {
+		return false, err
+	}
+	if err := d.clearResults(0); err != nil {
+		return false, err
+	}
+	if err := d.searchKernels[0].SetArg(3, nonce); err != nil {
+		return false, err
+	}
+	if err := released(d.queue.EnqueueNDRangeKernel(d.searchKernels[0], nil, []int{1}, []int{1}, nil)); err != nil {
+		return false, err
+	}
+
+	var results searchResults
+	if err := released(d.queue.EnqueueReadBuffer(d.searchBufs[0], true, 0, searchBufSize, unsafe.Pointer(&results), nil)); err != nil {
+		return false, err
+	}
+	return results.Count == 1 && results.Nonces[0] == nonce, nil
+}
+
+// hashOne runs czzhash_hash for a single nonce and returns the hash it
+// wrote, in Hasher.Hash byte order.
+func (d *OpenCLDevice) hashOne(header Hash, nonce uint64) (Hash, error) {
+	headerBuf, err := d.ctx.CreateEmptyBuffer(cl.MemReadOnly, 32)
+	if err != nil {
+		return Hash{}, err
+	}
+	defer headerBuf.Release()
+
+	outBuf, err := d.ctx.CreateEmptyBuffer(cl.MemWriteOnly, 32)
+	if err != nil {
+		return Hash{}, err
+	}
+	defer outBuf.Release()
+
+	if err = released(d.queue.EnqueueWriteBuffer(headerBuf, true, 0, 32, unsafe.Pointer(&header), nil)); err != nil {
+		return Hash{}, err
+	}
+	if err = d.hashKernel.SetArgs(outBuf, headerBuf, d.binBuf, nonce); err != nil {
+		return Hash{}, err
+	}
+	if err = released(d.queue.EnqueueNDRangeKernel(d.hashKernel, nil, []int{1}, []int{1}, nil)); err != nil {
+		return Hash{}, err
+	}
+
+	var result Hash
+	if err = released(d.queue.EnqueueReadBuffer(outBuf, true, 0, 32, unsafe.Pointer(&result), nil)); err != nil {
+		return Hash{}, err
+	}
+	var h Hash
+	for i := range result {
+		h[i] = result[HashLength-1-i]
+	}
+	return h, nil
+}
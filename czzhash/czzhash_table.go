@@ -0,0 +1,211 @@
+package czzhash
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	// TableFile is the file name of the table.
+	TableFile = "csatable.bin"
+	// TableEnv names the environment variable that overrides the table path.
+	TableEnv = "CZZHASH_TABLE"
+)
+
+// TableNetwork describes the table of a network.
+type TableNetwork struct {
+	// Digest is the hex SHA3-256 digest of the table, empty if unknown.
+	Digest string
+}
+
+// TableNetworks holds the table of each network. No digests are published
+// for the classzz tables yet, so until they are added here the table is only
+// checked against a digest the operator gives, see TableConfig. classzz
+// hashes every block with the one table chainhash.HashCZZ loads, so there
+// are no table epochs either.
+var TableNetworks = map[string]TableNetwork{
+	"mainnet": {},
+	"testnet": {},
+}
+
+var (
+	// ErrTableSize means the table file is not TBLSize bytes long.
+	ErrTableSize = errors.New("table has the wrong size")
+	// ErrTableDigest means the table does not hash to the expected digest.
+	ErrTableDigest = errors.New("table digest mismatch")
+)
+
+// TableError reports a table that is missing, unreadable, truncated or
+// corrupted. Nothing should be hashed with it.
+type TableError struct {
+	Path string
+	Err  error
+}
+
+func (e *TableError) Error() string {
+	return fmt.Sprintf("czzhash table %s: %v", e.Path, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *TableError) Unwrap() error { return e.Err }
+
+// TableConfig says where the table of epoch 0 is and what the tables have to
+// hash to. There is no known generator for the tables of the networks, so a
+// missing table is an error. A table with a wrong digest makes every share
+// invalid, so a table without a digest is loaded with a warning.
+type TableConfig struct {
+	Path       string   // see TablePath
+	Digests    []string // hex SHA3-256 of the table of epoch 0, 1, ...
+	Unverified bool     // skip the digest check, and its warning, on purpose
+
+	// EpochLength is the number of blocks a table is used for, 0 for a
+	// single table as on classzz. See TableManager.
+	EpochLength uint64
+}
+
+// digest returns the digest of the table of epoch, empty if there is none.
+func (cfg *TableConfig) digest(epoch uint64) string {
+	if epoch >= uint64(len(cfg.Digests)) {
+		return ""
+	}
+	return cfg.Digests[epoch]
+}
+
+// NetworkTable returns the configuration for the table of network at path.
+func NetworkTable(network, path string) (TableConfig, error) {
+	n, ok := TableNetworks[network]
+	if !ok {
+		return TableConfig{}, fmt.Errorf("unknown network %q", network)
+	}
+	cfg := TableConfig{Path: path}
+	if n.Digest != "" {
+		cfg.Digests = []string{n.Digest}
+	}
+	return cfg, nil
+}
+
+// GenerateCsatable deterministically expands seed into a table with
+// SHAKE256. This is how test tables are made, not how the table of any
+// network was.
+func GenerateCsatable(seed []byte) *Csatable {
+	c := NewCsatable()
+	sha3.ShakeSum256(c.data, seed)
+	return c
+}
+
+// WriteTable atomically writes the table to path, creating the directory if
+// needed, and returns its digest.
+func WriteTable(path string, c *Csatable) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	digest := TableDigest(c)
+	err := writeFileAtomic(path, c.data)
+	runtime.KeepAlive(c)
+	if err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
+// writeFileAtomic writes data to a temporary file in the directory of path
+// and renames it over path once it is synced.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// DefaultDataDir is the directory the table is looked for in by default,
+// ~/.miner-gpu.
+func DefaultDataDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(home, ".miner-gpu")
+}
+
+// DefaultKernelCache returns the directory compiled kernels are cached in
+// by default, kernels in DefaultDataDir.
+func DefaultKernelCache() string {
+	return filepath.Join(DefaultDataDir(), "kernels")
+}
+
+// TablePath resolves the table path: path if set, else $CZZHASH_TABLE, else
+// csatable.bin in the working directory if there is one, else csatable.bin
+// in DefaultDataDir.
+func TablePath(path string) string {
+	if path != "" {
+		return path
+	}
+	if env := os.Getenv(TableEnv); env != "" {
+		return env
+	}
+	if _, err := os.Stat(TableFile); err == nil {
+		return TableFile
+	}
+	return filepath.Join(DefaultDataDir(), TableFile)
+}
+
+// TableDigest returns the hex SHA3-256 digest of the table.
+func TableDigest(c *Csatable) string {
+	sum := sha3.Sum256(c.data)
+	runtime.KeepAlive(c)
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadTable maps the table at path read-only and checks it against digest,
+// an empty digest skips the check. All errors are *TableError.
+func LoadTable(path, digest string) (*Csatable, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, &TableError{Path: path, Err: err}
+	}
+	defer file.Close()
+
+	stats, err := file.Stat()
+	if err != nil {
+		return nil, &TableError{Path: path, Err: err}
+	}
+	if stats.Size() != TBLSize {
+		return nil, &TableError{Path: path, Err: fmt.Errorf("%w: %d bytes, want %d", ErrTableSize, stats.Size(), TBLSize)}
+	}
+
+	tbl, err := mapTable(file)
+	if err != nil {
+		return nil, &TableError{Path: path, Err: err}
+	}
+	if digest != "" {
+		if got := TableDigest(tbl); !strings.EqualFold(got, digest) {
+			return nil, &TableError{Path: path, Err: fmt.Errorf("%w: got %s, want %s", ErrTableDigest, got, digest)}
+		}
+	}
+	return tbl, nil
+}
@@ -0,0 +1,54 @@
+package czzhash
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/classzz/classzz/chaincfg/chainhash"
+)
+
+// maxTarget is the largest value a 256 bit target can take.
+var maxTarget = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+
+// ParseTarget parses the target of a getwork result. Up to 8 hex digits are
+// read as compact bits (see chainhash.CompactToBig), longer strings as a big
+// endian 256 bit number. An optional 0x prefix is accepted.
+func ParseTarget(s string) (*big.Int, error) {
+	s = strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(s), "0x"), "0X")
+	if s == "" {
+		return nil, fmt.Errorf("empty target")
+	}
+
+	var target *big.Int
+	if len(s) <= 8 {
+		bits, err := strconv.ParseUint(s, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid compact target %q: %v", s, err)
+		}
+		target = chainhash.CompactToBig(uint32(bits))
+	} else {
+		var ok bool
+		if target, ok = new(big.Int).SetString(s, 16); !ok {
+			return nil, fmt.Errorf("invalid target %q", s)
+		}
+	}
+
+	if target.Sign() <= 0 || target.Cmp(maxTarget) > 0 {
+		return nil, fmt.Errorf("target %q out of range", s)
+	}
+	return target, nil
+}
+
+// TargetBytes returns target as the 32 byte big endian value the kernel
+// compares hashes with. Targets above 2^256-1 are clamped.
+func TargetBytes(target *big.Int) [32]byte {
+	var buf [32]byte
+	if target.Cmp(maxTarget) > 0 {
+		target = maxTarget
+	}
+	b := target.Bytes()
+	copy(buf[32-len(b):], b)
+	return buf
+}
@@ -0,0 +1,42 @@
+package czzhash
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // hex, empty for an error
+	}{
+		{"1d00ffff", "ffff0000000000000000000000000000000000000000000000000000"},
+		{"0x1d00ffff", "ffff0000000000000000000000000000000000000000000000000000"},
+		{" 207fffff ", "7fffff0000000000000000000000000000000000000000000000000000000000"},
+		{"00000000ffff0000000000000000000000000000000000000000000000000000", "ffff0000000000000000000000000000000000000000000000000000"},
+		{"0X00ff", ""}, // compact bits of a zero target
+		{"ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"},
+		{"", ""},
+		{"0x", ""},
+		{"zz", ""},
+		{"00000000", ""},
+		{"0000000000000000000000000000000000000000000000000000000000000000", ""},
+		{"01ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", ""},
+		{"not a target at all", ""},
+	}
+	for _, tt := range tests {
+		got, err := ParseTarget(tt.in)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("ParseTarget(%q) = %x, want an error", tt.in, got)
+			}
+			continue
+		}
+		want, _ := new(big.Int).SetString(tt.want, 16)
+		if err != nil {
+			t.Errorf("ParseTarget(%q): %v", tt.in, err)
+		} else if got.Cmp(want) != 0 {
+			t.Errorf("ParseTarget(%q) = %x, want %x", tt.in, got, want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package czzhash
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Vector is a known czzhash result. The table is TestTable(TableSeed), Header
+// and Result are hex encoded and Result is in the byte order returned by
+// chainhash.HashCZZ and Hasher.Hash.
+type Vector struct {
+	TableSeed string
+	Header    string
+	Nonce     uint64
+	Result    string
+}
+
+// Vectors were produced with chainhash.HashCZZ. The tests and selftest
+// check the vectors of every seed against it. Every implementation of the
+// hash (Hasher, CPUMiner, the OpenCL kernel) must reproduce them exactly.
+var Vectors = []Vector{
+	{"czzhash-vectors-1", "0000000000000000000000000000000000000000000000000000000000000000", 0x0000000000000000, "687dae9467c0966390bc3161392f18e5c8c941d79774525eea58347a688e1fa8"},
+	{"czzhash-vectors-1", "6fe1a8c2b57f96c0f4e2a6d9135b8d0e7c4f0a3b9e2d6c1f8a5b4e3d2c1b0a99", 0x0000000000000001, "1b6a7e8460b010dfe37b9e8bf5c3bdab64200ac4415d2373518c2e3b4a798770"},
+	{"czzhash-vectors-1", "6fe1a8c2b57f96c0f4e2a6d9135b8d0e7c4f0a3b9e2d6c1f8a5b4e3d2c1b0a99", 0x00000000ffffffff, "4771e4f7e4320e779c98ff6d890eceef9081194478137955673af5e18c5dc721"},
+	{"czzhash-vectors-1", "6fe1a8c2b57f96c0f4e2a6d9135b8d0e7c4f0a3b9e2d6c1f8a5b4e3d2c1b0a99", 0x0000000100000000, "d8440dfe77204c7d7ced5c06753cd723adfdd8ca8af897e26df15bef01565049"},
+	{"czzhash-vectors-1", "00112233445566778899aabbccddeeff102132435465768798a9bacbdcedfe0f", 0x0123456789abcdef, "3e32cfb836bde65f00da0acb3558bc9addfa63301c6c667e61c2fcd93a9b6989"},
+	{"czzhash-vectors-1", "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 0xfffffffffffffffe, "077001eff5184d33a4f1bfafd090f88f0e9a50490eabacb7b4c267fe6d744360"},
+	{"czzhash-vectors-2", "0000000000000000000000000000000000000000000000000000000000000000", 0x0000000000000000, "1d5187617b9c3626efa457a8e60e6e48d0e93b0e67fe6c31eb183b8da71b75d1"},
+	{"czzhash-vectors-2", "8d3b1f6a0c9e7d5b3a1f0e2c4d6b8a9f7e5c3d1b0a2f4e6c8d0b9a7f5e3c1d2b", 0x00000000deadbeef, "9f592b5f7ac5c36f332e3404cd9f0642055ac514179abd3b59eea10603d5c63d"},
+	{"czzhash-vectors-2", "8d3b1f6a0c9e7d5b3a1f0e2c4d6b8a9f7e5c3d1b0a2f4e6c8d0b9a7f5e3c1d2b", 0xdeadbeef00000000, "ec8c8d1b35f3f484d01dbfeae7d0dbc640fd458e2b72fbc546d60664f56da2ee"},
+	{"czzhash-vectors-2", "00112233445566778899aabbccddeeff102132435465768798a9bacbdcedfe0f", 0x8000000000000000, "b22f07337addfdbe13d37213e29eebcfb3001c70540ec5420318ee45fc1b51db"},
+}
+
+// ErrVectorSkipped is returned by a VectorHashFunc for vectors it cannot
+// evaluate, e.g. because they need a different table than the one loaded.
+var ErrVectorSkipped = errors.New("vector skipped")
+
+// VectorHashFunc hashes the header and nonce of v with tbl. tbl is generated
+// once per seed, consecutive vectors with the same seed get the same pointer.
+type VectorHashFunc func(v *Vector, tbl *Csatable) (Hash, error)
+
+// TestTable is the table GenerateCsatable builds from a vector seed. It is
+// not the table of any network.
+func TestTable(seed string) *Csatable {
+	return GenerateCsatable([]byte(seed))
+}
+
+// VerifyVectors runs every vector through fn and returns the number of
+// vectors checked. It stops at the first mismatch.
+func VerifyVectors(fn VectorHashFunc) (int, error) {
+	var (
+		seed    string
+		tbl     *Csatable
+		checked int
+	)
+	for i := range Vectors {
+		v := &Vectors[i]
+		if tbl == nil || v.TableSeed != seed {
+			seed, tbl = v.TableSeed, TestTable(v.TableSeed)
+		}
+		header, err := decodeHash(v.Header)
+		if err != nil {
+			return checked, fmt.Errorf("vector %d: header: %v", i, err)
+		}
+		want, err := decodeHash(v.Result)
+		if err != nil {
+			return checked, fmt.Errorf("vector %d: result: %v", i, err)
+		}
+
+		got, err := fn(v, tbl)
+		if err == ErrVectorSkipped {
+			continue
+		}
+		if err != nil {
+			return checked, fmt.Errorf("vector %d: %v", i, err)
+		}
+		if got != want {
+			return checked, fmt.Errorf("vector %d (seed %q, header %x, nonce %#x): got %x, want %x",
+				i, v.TableSeed, header, v.Nonce, got, want)
+		}
+		checked++
+	}
+	return checked, nil
+}
+
+// DeviceVectorResult is the outcome of running the vectors on one device.
+type DeviceVectorResult struct {
+	Device  string
+	Checked int
+	Err     error
+}
+
+// VerifyCPU checks Hasher and the CPUMiner search loop against the vectors.
+// The search starts at the vector's nonce with the vector's hash as target
+// and must stop right there.
+func VerifyCPU() (int, error) {
+	var (
+		tbl    *Csatable
+		hasher *Hasher
+		c      = &CPUMiner{czzhash: New(), threads: 1}
+	)
+	return VerifyVectors(func(v *Vector, t *Csatable) (Hash, error) {
+		if t != tbl {
+			tbl, hasher = t, NewHasher(t)
+		}
+		header, _ := decodeHash(v.Header)
+		result, _ := decodeHash(v.Result)
+
+		su := c.search(hasher, header, HashToBig(result), NonceRange{Start: v.Nonce, Count: 1}, nil)
+		if len(su.Found) != 1 || su.Found[0] != v.Nonce {
+			return Hash{}, fmt.Errorf("search returned nonces %#x, want %#x", su.Found, v.Nonce)
+		}
+		return hasher.Hash(header, v.Nonce), nil
+	})
+}
+
+func decodeHash(s string) (Hash, error) {
+	var h Hash
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return h, err
+	}
+	if len(b) != HashLength {
+		return h, fmt.Errorf("hash length %d, want %d", len(b), HashLength)
+	}
+	copy(h[:], b)
+	return h, nil
+}
@@ -0,0 +1,175 @@
+package czzhash
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/classzz/classzz/chaincfg/chainhash"
+	"golang.org/x/crypto/sha3"
+)
+
+// chainhashVectorsEnv holds the JSON encoded vectors TestChainhashVectors
+// checks, set by checkChainhash for the process it runs it in.
+const chainhashVectorsEnv = "CZZHASH_TEST_CHAINHASH_VECTORS"
+
+func TestVectorsHasher(t *testing.T) {
+	var (
+		tbl    *Csatable
+		hasher *Hasher
+	)
+	n, err := VerifyVectors(func(v *Vector, t *Csatable) (Hash, error) {
+		if t != tbl {
+			tbl, hasher = t, NewHasher(t)
+		}
+		header, err := decodeHash(v.Header)
+		if err != nil {
+			return Hash{}, err
+		}
+		return hasher.Hash(header, v.Nonce), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(Vectors) {
+		t.Fatalf("checked %d of %d vectors", n, len(Vectors))
+	}
+}
+
+func TestVectorsCPU(t *testing.T) {
+	n, err := VerifyCPU()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(Vectors) {
+		t.Fatalf("checked %d of %d vectors", n, len(Vectors))
+	}
+}
+
+// TestVectorsChainhash checks the vectors of every table seed against
+// chainhash.HashCZZ, in a directory holding the table of the seed.
+func TestVectorsChainhash(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a process per table seed")
+	}
+	seeds := make(map[string][]Vector)
+	var order []string
+	for _, v := range Vectors {
+		if _, ok := seeds[v.TableSeed]; !ok {
+			order = append(order, v.TableSeed)
+		}
+		seeds[v.TableSeed] = append(seeds[v.TableSeed], v)
+	}
+
+	for _, seed := range order {
+		dir := tempDir(t)
+		if err := ioutil.WriteFile(filepath.Join(dir, TableFile), TestTable(seed).Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		checkChainhash(t, dir, "seed "+seed, seeds[seed])
+	}
+}
+
+// TestNetworkTableChainhash checks Hasher against chainhash.HashCZZ with the
+// table at TablePath, the table of the network, on a few headers. There are
+// no published results for that table, so both have to agree instead. It is
+// skipped where there is no table.
+func TestNetworkTableChainhash(t *testing.T) {
+	path, err := filepath.Abs(TablePath(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Skip("no table at", path)
+	}
+	tbl, err := LoadTable(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasher := NewHasher(tbl)
+	var vectors []Vector
+	for i := uint64(0); i < 4; i++ {
+		header := Hash(sha3.Sum256([]byte(fmt.Sprintf("czzhash-network-table-%d", i))))
+		nonce := i * 0x9e3779b97f4a7c15
+		result := hasher.Hash(header, nonce)
+		vectors = append(vectors, Vector{
+			Header: hex.EncodeToString(header[:]),
+			Nonce:  nonce,
+			Result: hex.EncodeToString(result[:]),
+		})
+	}
+
+	// HashCZZ only loads TableFile, whatever the name of the table
+	dir := tempDir(t)
+	if err := os.Symlink(path, filepath.Join(dir, TableFile)); err != nil {
+		t.Fatal(err)
+	}
+	checkChainhash(t, dir, path, vectors)
+}
+
+// checkChainhash checks vectors against chainhash.HashCZZ with the table in
+// dir, which is named by table in errors. HashCZZ loads TableFile from the working directory once per process,
+// so TestChainhashVectors checks them in a test process of its own, started
+// in dir.
+func checkChainhash(t *testing.T, dir, table string, vectors []Vector) {
+	js, err := json.Marshal(vectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestChainhashVectors$", "-test.v")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), chainhashVectorsEnv+"="+string(js))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %v\n%s", table, err, out)
+	}
+	if !strings.Contains(string(out), "--- PASS: TestChainhashVectors") {
+		t.Fatalf("%s: TestChainhashVectors did not run\n%s", table, out)
+	}
+}
+
+// TestChainhashVectors checks the vectors in chainhashVectorsEnv against
+// chainhash.HashCZZ with the table in the working directory. It only runs
+// as part of checkChainhash.
+func TestChainhashVectors(t *testing.T) {
+	js := os.Getenv(chainhashVectorsEnv)
+	if js == "" {
+		t.Skip("run by checkChainhash")
+	}
+	var vectors []Vector
+	if err := json.Unmarshal([]byte(js), &vectors); err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors) == 0 {
+		t.Fatal("no vectors")
+	}
+	for i, v := range vectors {
+		header, err := hex.DecodeString(v.Header)
+		if err != nil {
+			t.Fatalf("vector %d: header: %v", i, err)
+		}
+		res := chainhash.HashCZZ(header, v.Nonce)
+		if res == nil {
+			t.Fatal("HashCZZ failed to load the table")
+		}
+		if got := hex.EncodeToString(res); got != v.Result {
+			t.Errorf("vector %d (nonce %#x): got %s, want %s", i, v.Nonce, got, v.Result)
+		}
+	}
+}
+
+// tempDir returns a directory removed once t is done.
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "czzhash-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
@@ -0,0 +1,79 @@
+package czzhash
+
+import (
+	"math/big"
+	"sync"
+)
+
+// DeviceStats counts the nonces a device reported and how many of them did
+// not hold up when rehashed on the host.
+type DeviceStats struct {
+	Accepted       uint64
+	HardwareErrors uint64
+	Quarantined    bool
+}
+
+// Verifier rehashes every nonce found by a backend on the host before it is
+// submitted. A device whose hardware error rate exceeds MaxErrorRate after at
+// least MinSamples nonces is quarantined.
+type Verifier struct {
+	MaxErrorRate float64
+	MinSamples   uint64
+
+	mu    sync.Mutex // protects stats
+	stats map[DeviceID]*DeviceStats
+}
+
+// NewVerifier returns a Verifier with the given quarantine thresholds.
+func NewVerifier(maxErrorRate float64, minSamples uint64) *Verifier {
+	return &Verifier{
+		MaxErrorRate: maxErrorRate,
+		MinSamples:   minSamples,
+		stats:        make(map[DeviceID]*DeviceStats),
+	}
+}
+
+// Verify reports whether nonce really hashes header to at most target with
+// h, the Hasher of the table the work was searched with, and records the
+// outcome against device id.
+func (v *Verifier) Verify(id DeviceID, h *Hasher, header Hash, nonce uint64, target *big.Int) bool {
+	ok := HashToBig(h.Hash(header, nonce)).Cmp(target) <= 0
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	s := v.device(id)
+	if ok {
+		s.Accepted++
+	} else {
+		s.HardwareErrors++
+	}
+	total := s.Accepted + s.HardwareErrors
+	if total >= v.MinSamples && float64(s.HardwareErrors)/float64(total) > v.MaxErrorRate {
+		s.Quarantined = true
+	}
+	return ok
+}
+
+// Quarantined reports whether device id has been taken out of service.
+func (v *Verifier) Quarantined(id DeviceID) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.device(id).Quarantined
+}
+
+// Stats returns a copy of the counters of device id.
+func (v *Verifier) Stats(id DeviceID) DeviceStats {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return *v.device(id)
+}
+
+func (v *Verifier) device(id DeviceID) *DeviceStats {
+	s, ok := v.stats[id]
+	if !ok {
+		s = &DeviceStats{}
+		v.stats[id] = s
+	}
+	return s
+}
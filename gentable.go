@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/classzz/miner-gpu/czzhash"
+)
+
+// gentable is the test table generator: it expands -seed into a table and
+// writes it to -out. Test tables are not the table of any network and cannot
+// produce valid shares on one; they are for benchmarks and for mining against
+// test nodes that load the same table. The table of a network cannot be
+// generated, it has to be obtained with the node.
+func gentable(args []string) {
+	fs := flag.NewFlagSet("gentable", flag.ExitOnError)
+	var SeedFlag = fs.String("seed", "", "Seed the test table is generated from")
+	var OutFlag = fs.String("out", "", "Where to write the test table, never a default so it does not stand in for the table of a network")
+	var ForceFlag = fs.Bool("force", false, "Overwrite an existing file")
+	fs.Parse(args)
+
+	if *SeedFlag == "" {
+		log.Fatal("-seed is required, gentable only makes test tables; the table of a network cannot be generated")
+	}
+	if *OutFlag == "" {
+		log.Fatal("-out is required")
+	}
+
+	path := *OutFlag
+	if _, err := os.Stat(path); err == nil && !*ForceFlag {
+		log.Fatal(path, " exists, use -force to overwrite it")
+	}
+
+	sum, err := czzhash.WriteTable(path, czzhash.GenerateCsatable([]byte(*SeedFlag)))
+	if err != nil {
+		log.Fatal("WriteTable", "err", err)
+	}
+	log.Println("Test table written", "path:", path, "digest:", sum)
+}
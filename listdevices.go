@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/classzz/miner-gpu/czzhash"
+)
+
+// listDevices prints the GPUs of every OpenCL platform with what matters for
+// mining on them, as a table or as JSON.
+func listDevices(args []string) {
+	fs := flag.NewFlagSet("list-devices", flag.ExitOnError)
+	var JSONFlag = fs.Bool("json", false, "Print the devices as a JSON array")
+	fs.Parse(args)
+
+	devices, err := czzhash.Devices()
+	if err != nil {
+		log.Fatal("list-devices", "err", err)
+	}
+
+	if *JSONFlag {
+		if devices == nil {
+			devices = []czzhash.DeviceInfo{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(devices); err != nil {
+			log.Fatal("list-devices", "err", err)
+		}
+		return
+	}
+
+	if len(devices) == 0 {
+		fmt.Println("No GPU devices found")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "INDEX\tID\tPLATFORM\tNAME\tVENDOR\tDRIVER\tOPENCL\tCU\tGLOBAL MEM\tMAX ALLOC\tMAX WG\tTABLE FITS")
+	for _, d := range devices {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d MiB\t%d MiB\t%d\t%v\n",
+			d.Index, d.ID, d.Platform, d.Name, d.Vendor, d.DriverVersion, d.Version,
+			d.ComputeUnits, d.GlobalMemSize>>20, d.MaxMemAllocSize>>20, d.MaxWorkGroupSize, d.TableFits)
+	}
+	w.Flush()
+}
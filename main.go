@@ -1,85 +1,300 @@
 package main
 
 import (
+	crand "crypto/rand"
 	"flag"
-	"github.com/classzz/classzz/rpcclient"
+	"fmt"
 	"github.com/classzz/miner-gpu/czzhash"
 	"log"
+	"math"
 	"math/big"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
+// commands are run as "miner-gpu <command> [flags]", anything else starts
+// mining.
+var commands = map[string]func(args []string){
+	"selftest":     selftest,
+	"hashczz":      hashczz, // run by selftest
+	"proxy":        proxy,
+	"gentable":     gentable,
+	"benchmark":    benchmark,
+	"autotune":     autotune,
+	"list-devices": listDevices,
+	"gpuinfo":      listDevices, // the name older messages used
+}
+
 type Miner struct {
-	Hash     string
-	Target   *big.Int
-	Client   *rpcclient.Client
-	Cl       *czzhash.OpenCLMiner
-	Nonce    chan uint64
-	Stop     chan struct{}
-	CancelWg sync.WaitGroup
+	Source     WorkSource
+	Cl         czzhash.Searcher
+	Verifier   *czzhash.Verifier
+	bin        *czzhash.Csatable // the table of the latest job
+	hasher     *czzhash.Hasher   // for bin, to verify the shares of its jobs
+	Supervisor *supervisor
+	Nonces     *nonceAllocator
+	Quit       chan struct{}  // closed to shut the miner down
+	CancelWg   sync.WaitGroup // device loops and the submitter
+
+	stop chan struct{} // closed once fetch returned, ends the device loops
+
+	mu      sync.Mutex      // protects job and changed
+	job     *job            // the job the devices hash, nil while there is none
+	changed chan struct{}   // closed when job is replaced
+	refresh chan struct{}   // asks fetch for new work
+	submits chan submission // nonces sent, waiting for their answer
 }
 
-// miner
-func (m *Miner) mining() {
+// mining runs until Quit is closed. Work fetching, the search loop of each
+// device and share submission run concurrently: fetch publishes jobs, the
+// devices switch to a new job as soon as it is published and hand the shares
+// they find to SubmitWorkAsync. mining only returns an error when mining
+// cannot go on: no work can be had or every device is out.
+func (m *Miner) mining() error {
+	m.changed = make(chan struct{})
+	m.refresh = make(chan struct{}, 1)
+	m.submits = make(chan submission, submitQueue)
+	m.stop = make(chan struct{})
 
-	for {
-		m.Stop = make(chan struct{})
-		work, err := m.Client.GetWork()
-		if err != nil {
-			log.Fatal("GetWork ", "err", err)
+	m.CancelWg.Add(1)
+	go func() {
+		defer m.CancelWg.Done()
+		m.submitter()
+	}()
+
+	var devices sync.WaitGroup
+	for _, id := range m.Cl.Devices() {
+		if m.Verifier.Quarantined(id) || m.Supervisor.Disabled(id) {
 			continue
 		}
-		log.Println("GetWork", "Hash", work.Hash, "Target", work.Target)
-
-		m.Hash = work.Hash
-		target := big.NewInt(0).SetBytes([]byte(work.Target))
-		m.Target = target
-
-		hash := czzhash.Hash{}
-		hash.SetBytes([]byte(m.Hash))
+		devices.Add(1)
+		m.CancelWg.Add(1)
+		go func(id czzhash.DeviceID) {
+			defer m.CancelWg.Done()
+			defer devices.Done()
+			m.device(id)
+		}(id)
+	}
+	out := make(chan struct{})
+	go func() {
+		devices.Wait()
+		// no device submits any more
+		close(m.submits)
+		close(out)
+	}()
 
-		//Hashrate
-		fetchers := []func() *czzhash.Result{}
+	err := m.fetch(out)
+	// without fetch no job comes any more, the devices still searching or
+	// waiting for one stop
+	close(m.stop)
+	m.publish(nil)
+	return err
+}
 
-		for i := 0; i < m.Cl.GetDeviceCount(); i++ {
-			index := big.NewInt(int64(i))
-			fetchers = append(fetchers, func() *czzhash.Result { return m.Cl.Search(hash, m.Target.Uint64(), m.Stop, index.Int64()) })
+// tableFlags registers the table flags on fs. The returned function resolves
+// them once fs is parsed.
+func tableFlags(fs *flag.FlagSet) func() czzhash.TableConfig {
+	var TableFlag = fs.String("table", "", "Path of "+czzhash.TableFile+" (default $"+czzhash.TableEnv+", ./"+czzhash.TableFile+" or "+filepath.Join(czzhash.DefaultDataDir(), czzhash.TableFile)+")")
+	var NetworkFlag = fs.String("network", "mainnet", "Network whose table digest is checked: mainnet or testnet")
+	var DigestFlag = fs.String("table-digest", "", "Hex SHA3-256 digest the table must have, overrides the one of -network; with -epoch-length the comma separated digests of epoch 0, 1, ...")
+	var UnverifiedFlag = fs.Bool("no-table-digest", false, "Do not check the table against a digest, nor warn that there is none; a wrong table makes every share invalid")
+	var EpochFlag = fs.Uint64("epoch-length", 0, "Blocks per table for chains that switch tables, epoch N is read from csatable-N.bin; 0 for a single table as on classzz")
+	return func() czzhash.TableConfig {
+		table, err := czzhash.NetworkTable(*NetworkFlag, *TableFlag)
+		if err != nil {
+			log.Fatal("table", "err", err)
 		}
+		if *DigestFlag != "" {
+			table.Digests = splitList(*DigestFlag)
+		}
+		table.Unverified = *UnverifiedFlag
+		table.EpochLength = *EpochFlag
+		return table
+	}
+}
 
-		result := make(chan *czzhash.Result, len(fetchers))
-		m.CancelWg.Add(len(fetchers))
-		for _, fn := range fetchers {
-			fn := fn
-			go func() {
-				defer m.CancelWg.Done()
-				result <- fn()
-			}()
+// backendFlags adds the flags choosing and tuning the mining backend to fs
+// and returns a function building the backend they describe.
+func backendFlags(fs *flag.FlagSet, table func() czzhash.TableConfig) func() czzhash.Searcher {
+	var BackendFlag = fs.String("backend", "opencl", "Mining backend: opencl or cpu")
+	var ThreadsFlag = fs.Int("threads", 0, "CPU backend threads (0 = one per CPU)")
+	var KernelCacheFlag = fs.String("kernel-cache", czzhash.DefaultKernelCache(), "Directory compiled kernels are cached in per device and driver, empty to build them on every start")
+	devices := deviceFlags(fs)
+	return func() czzhash.Searcher {
+		switch *BackendFlag {
+		case "opencl":
+			_, configs, err := devices()
+			if err != nil {
+				log.Fatal("devices", "err", err)
+			}
+			Cl := czzhash.NewCL(configs, table())
+			Cl.KernelCache = *KernelCacheFlag
+			return Cl
+		case "cpu":
+			return czzhash.NewCPU(*ThreadsFlag, table())
 		}
+		log.Fatal("unknown backend ", *BackendFlag)
+		return nil
+	}
+}
+
+// deviceFlags adds the flags selecting and tuning GPUs to fs and returns a
+// function selecting the devices they describe.
+func deviceFlags(fs *flag.FlagSet) func() ([]czzhash.DeviceInfo, []czzhash.DeviceConfig, error) {
+	var DevicesFlag = fs.String("devices", "", "Comma separated GPUs to mine on by index, id, PCI bus id (01:00.0) or name pattern (*RX*580*); all if empty")
+	var ExcludeFlag = fs.String("exclude", "", "Comma separated GPUs not to mine on, as in -devices")
+	var WorksizeFlag = fs.String("worksize", "", "Work group size of the selected GPUs, comma separated in order or one for all (0 = default)")
+	var BatchFlag = fs.String("batch", "", "Work groups per compute unit in one dispatch, as in -worksize")
+	var IntensityFlag = fs.String("intensity", "", "Log2 of the nonces hashed per dispatch, overrides -batch, as in -worksize")
+	var TuningFlag = fs.String("tuning", filepath.Join(czzhash.DefaultDataDir(), tuningFile), "Cache of the settings found by autotune, applied unless -worksize, -batch or -intensity say otherwise")
+	return func() ([]czzhash.DeviceInfo, []czzhash.DeviceConfig, error) {
+		return deviceConfigs(*DevicesFlag, *ExcludeFlag, *WorksizeFlag, *BatchFlag, *IntensityFlag, *TuningFlag)
+	}
+}
 
-		hashRate := uint64(0)
-		Nonce := uint64(0)
-		for i := 0; i < len(fetchers); i++ {
-			var result_ *czzhash.Result
-			if result_ = <-result; err == nil && Nonce == 0 {
-				Nonce = result_.Nonce
-				close(m.Stop)
+// deviceConfigs selects the GPUs to mine on and tunes them from the
+// -devices, -exclude, -worksize, -batch and -intensity flags, falling back
+// to the autotune cache at tuningPath.
+func deviceConfigs(include, exclude, worksize, batch, intensity, tuningPath string) ([]czzhash.DeviceInfo, []czzhash.DeviceConfig, error) {
+	devices, err := czzhash.Devices()
+	if err != nil {
+		return nil, nil, err
+	}
+	selected, err := czzhash.SelectDevices(devices, splitList(include), splitList(exclude))
+	if err != nil {
+		return nil, nil, err
+	}
+	cache, err := loadTuning(tuningPath)
+	if err != nil {
+		log.Println("WARNING: tuning cache not loaded", "path:", tuningPath, "err:", err)
+	}
+
+	configs := make([]czzhash.DeviceConfig, len(selected))
+	for i, d := range selected {
+		configs[i].ID = d.ID
+		log.Println("Device selected", "id:", d.ID, "index:", d.Index, "name:", d.Name, "bus:", d.PCIBusID)
+		if t, ok := cache[tuningKey(&d)]; ok {
+			configs[i].WorkGroupSize, configs[i].BatchMultiplier = t.WorkGroupSize, t.BatchMultiplier
+			log.Println("Device tuning loaded", "id:", d.ID, "worksize:", t.WorkGroupSize, "batch:", t.BatchMultiplier)
+		}
+	}
+	tunings := []struct {
+		name   string
+		values string
+		set    func(c *czzhash.DeviceConfig, v int)
+	}{
+		{"worksize", worksize, func(c *czzhash.DeviceConfig, v int) { c.WorkGroupSize = v }},
+		{"batch", batch, func(c *czzhash.DeviceConfig, v int) { c.BatchMultiplier = v }},
+		{"intensity", intensity, func(c *czzhash.DeviceConfig, v int) { c.Intensity = v }},
+	}
+	for _, t := range tunings {
+		values := splitList(t.values)
+		if len(values) > 1 && len(values) != len(configs) {
+			return nil, nil, fmt.Errorf("-%s: %d values for %d devices", t.name, len(values), len(configs))
+		}
+		for i := range configs {
+			if len(values) == 0 {
+				break
+			}
+			s := values[0]
+			if len(values) > 1 {
+				s = values[i]
 			}
-			hashRate = hashRate + result_.HashRate
+			v, err := strconv.Atoi(s)
+			if err != nil || v < 0 {
+				return nil, nil, fmt.Errorf("-%s: bad value %q", t.name, s)
+			}
+			t.set(&configs[i], v)
 		}
+	}
+	return selected, configs, nil
+}
 
-		log.Println("SubmitWork", "Nonce:", Nonce, "hashRate:", hashRate)
-		if err = m.Client.SubmitWork(m.Hash, Nonce); err != nil {
-			log.Fatal("SubmitWork", "err", err)
+// splitList splits a comma separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
 		}
+	}
+	return items
+}
+
+// reportHashrate logs the hash rate of each device and of all together
+// every interval until quit is closed.
+func reportHashrate(metrics *czzhash.Metrics, interval time.Duration, quit <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-quit:
+			return
+		}
+		var total [len(czzhash.RateWindows)]float64
+		for _, r := range metrics.Rates() {
+			log.Println("Hashrate", "device:", r.Device, "10s:", formatRate(r.Rates[0]), "60s:", formatRate(r.Rates[1]),
+				"15m:", formatRate(r.Rates[2]), "total:", r.Total)
+			if r.Dropped > 0 {
+				log.Println("WARNING: hits dropped by the device", "device:", r.Device, "dropped:", r.Dropped)
+			}
+			for i := range total {
+				total[i] += r.Rates[i]
+			}
+		}
+		log.Println("Hashrate", "10s:", formatRate(total[0]), "60s:", formatRate(total[1]), "15m:", formatRate(total[2]))
+	}
+}
 
+// formatRate formats a hash rate with a unit prefix, e.g. 12.34 MH/s.
+func formatRate(rate float64) string {
+	units := []string{"H/s", "kH/s", "MH/s", "GH/s", "TH/s"}
+	i := 0
+	for rate >= 1000 && i < len(units)-1 {
+		rate /= 1000
+		i++
 	}
+	return fmt.Sprintf("%.2f %s", rate, units[i])
+}
+
+// randomNonce returns a random 64 bit value to start searching from.
+func randomNonce() uint64 {
+	seed, _ := crand.Int(crand.Reader, big.NewInt(math.MaxInt64))
+	return rand.New(rand.NewSource(seed.Int64())).Uint64()
 }
 
 func main() {
 
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
+	}
+
 	var HostFlag = flag.String("h", "127.0.0.1:8334", "rpcclient Host ")
 	var UserFlag = flag.String("u", "", "User")
 	var PassFlag = flag.String("p", "", "Pass")
+	var WebsocketFlag = flag.Bool("ws", false, "Connect to the node over websocket and drop stale work on block notifications")
+	var PollFlag = flag.Duration("poll", 2*time.Second, "Interval of the best block check without -ws")
+	var PoolFlag = flag.String("pool", "", "Stratum pool to mine for, stratum+tcp://host:port (-u/-p name the worker); getwork from -h if empty")
+	var UpstreamFlag = flag.String("upstream", "", "Comma separated upstreams in order of preference, http://, ws:// (nodes) or stratum+tcp:// (pools) with user:pass@; overrides -h, -ws and -pool")
+	var TimeoutFlag = flag.Duration("timeout", 30*time.Second, "Fail over when an upstream sends no work for this long")
+	var FailbackFlag = flag.Duration("failback", 30*time.Second, "Interval of the checks whether a preferred upstream is back")
+	var HwErrRateFlag = flag.Float64("hwerr-rate", 0.1, "Quarantine a device once this fraction of its nonces fail host verification")
+	var HwErrMinFlag = flag.Uint64("hwerr-min", 5, "Nonces a device must report before it can be quarantined")
+	var ReportFlag = flag.Duration("report", 30*time.Second, "Interval of the hash rate log lines, 0 disables them")
+	table := tableFlags(flag.CommandLine)
+	backend := backendFlags(flag.CommandLine, table)
+	nonces := nonceFlags(flag.CommandLine)
 
 	flag.Parse()
 
@@ -90,36 +305,60 @@ func main() {
 		user, pass = *UserFlag, *PassFlag
 	}
 
-	connCfg := &rpcclient.ConnConfig{
-		Host:         *HostFlag,
-		Endpoint:     "http",
-		User:         user,
-		Pass:         pass,
-		HTTPPostMode: true, // Bitcoin core only supports HTTP POST mode
-		DisableTLS:   true, // Bitcoin core does not provide TLS by default
-	}
-
-	// Notice the notification parameter is nil since notifications are
-	// not supported in HTTP POST mode.
-	client, err := rpcclient.New(connCfg, nil)
+	endpoints, err := parseEndpoints(*UpstreamFlag)
 	if err != nil {
-		log.Fatal("rpcclient", "err", err)
+		log.Fatal("upstream", "err", err)
 	}
-	defer client.Shutdown()
+	if len(endpoints) == 0 {
+		e := &endpoint{scheme: "http", host: *HostFlag, user: user, pass: pass}
+		if *WebsocketFlag {
+			e.scheme = "ws"
+		}
+		if *PoolFlag != "" {
+			e.scheme, e.host = "stratum+tcp", strings.TrimPrefix(*PoolFlag, "stratum+tcp://")
+		}
+		endpoints = append(endpoints, e)
+	}
+	source := newFailoverSource(endpoints, *PollFlag, *TimeoutFlag, *FailbackFlag)
 
-	driverCount := czzhash.GetDeviceCount()
-	cls := []int{}
-	for i := 0; i < driverCount; i++ {
-		cls = append(cls, i)
+	Cl := backend()
+	if err = Cl.Init(0); err != nil {
+		log.Fatal("Init", "err", err)
 	}
-	Cl := czzhash.NewCL(cls)
-	err = czzhash.InitCL(0, Cl)
 
+	quit := make(chan struct{})
 	min := &Miner{
-		Cl:     Cl,
-		Client: client,
-		Stop:   make(chan struct{}),
+		Cl:         Cl,
+		Verifier:   czzhash.NewVerifier(*HwErrRateFlag, *HwErrMinFlag),
+		bin:        Cl.Bin(),
+		hasher:     czzhash.NewHasher(Cl.Bin()),
+		Supervisor: newSupervisor(Cl, quit),
+		Nonces:     nonces(),
+		Source:     source,
+		Quit:       quit,
 	}
 
-	min.mining()
+	// the first signal shuts down cleanly, a second one right away
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		log.Println("Shutting down", "signal:", s)
+		close(quit)
+		source.Close()
+		<-sig
+		os.Exit(1)
+	}()
+
+	if *ReportFlag > 0 {
+		go reportHashrate(Cl.Metrics(), *ReportFlag, quit)
+	}
+
+	err = min.mining()
+	min.CancelWg.Wait()
+	source.Close()
+	Cl.Close()
+	if err != nil {
+		log.Fatal("mining", "err", err)
+	}
 }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/bits"
+	"sync"
+
+	"github.com/classzz/miner-gpu/czzhash"
+)
+
+// maxJobSpaces is how many recent jobs the nonce allocator remembers, so a
+// job coming back, e.g. after a failover, continues where it stopped.
+const maxJobSpaces = 16
+
+// jobKey identifies the nonce space of a job. A new extranonce1 opens a new
+// space for the same job.
+type jobKey struct {
+	id     string
+	prefix uint64
+}
+
+// jobSpace is the part of the nonce space of a job that this rig searches:
+// the offsets up to mask, placed below the pool prefix and the rig id.
+type jobSpace struct {
+	key    jobKey
+	prefix uint64 // pool prefix and rig id
+	mask   uint64 // offsets the rig chooses
+	base   uint64 // offset the first range starts at
+	next   uint64 // offsets handed out so far, counted from base
+	done   bool   // every offset was handed out
+	hashed uint64 // nonces the devices reported hashed
+}
+
+// coverage returns the fraction of the space that was hashed.
+func (j *jobSpace) coverage() float64 {
+	return float64(j.hashed) / (float64(j.mask) + 1)
+}
+
+// nonceAllocator hands the devices disjoint, contiguous ranges of the nonce
+// space of each job, so no two devices and, with a rig id, no two rigs hash
+// the same nonces.
+type nonceAllocator struct {
+	rig     uint64 // placed into the top rigBits of the space a job leaves
+	rigBits uint
+	size    uint64 // nonces per range
+
+	mu   sync.Mutex  // protects jobs
+	jobs []*jobSpace // most recent last
+}
+
+func newNonceAllocator(rig uint64, rigBits uint, size uint64) (*nonceAllocator, error) {
+	if rigBits > 32 {
+		return nil, fmt.Errorf("rig id of %d bits, at most 32 are allowed", rigBits)
+	}
+	if rig>>rigBits != 0 {
+		return nil, fmt.Errorf("rig id %d does not fit %d bits", rig, rigBits)
+	}
+	if size == 0 {
+		return nil, fmt.Errorf("empty nonce ranges")
+	}
+	return &nonceAllocator{rig: rig, rigBits: rigBits, size: size}, nil
+}
+
+// nonceFlags registers the nonce allocation flags on fs. The returned
+// function builds the allocator once fs is parsed.
+func nonceFlags(fs *flag.FlagSet) func() *nonceAllocator {
+	var RigFlag = fs.Uint64("rig", 0, "Id of this rig, keeps the rigs of one worker out of each other's nonces")
+	var RigBitsFlag = fs.Uint("rig-bits", 0, "Nonce bits taken by -rig, 0 when mining on a single rig")
+	var RangeFlag = fs.Uint64("nonce-range", 1<<24, "Nonces handed to a device at a time")
+	return func() *nonceAllocator {
+		a, err := newNonceAllocator(*RigFlag, *RigBitsFlag, *RangeFlag)
+		if err != nil {
+			log.Fatal("nonces", "err", err)
+		}
+		return a
+	}
+}
+
+// job returns the space of w, opening it if w is new. The search starts at a
+// random offset so a restarted miner does not hash the ranges it did before.
+func (a *nonceAllocator) job(w *Work) (*jobSpace, error) {
+	key := jobKey{w.ID, w.NoncePrefix}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, j := range a.jobs {
+		if j.key == key {
+			return j, nil
+		}
+	}
+
+	free := uint(bits.Len64(w.NonceMask))
+	if a.rigBits > 0 && a.rigBits >= free {
+		return nil, fmt.Errorf("rig id of %d bits leaves nothing of the %d nonce bits of job %s", a.rigBits, free, w.ID)
+	}
+	shift := free - a.rigBits
+	j := &jobSpace{
+		key:    key,
+		prefix: w.NoncePrefix | a.rig<<shift,
+		mask:   w.NonceMask >> a.rigBits,
+	}
+	j.base = randomNonce() & j.mask
+
+	if len(a.jobs) == maxJobSpaces {
+		a.jobs = a.jobs[1:]
+	}
+	a.jobs = append(a.jobs, j)
+	return j, nil
+}
+
+// take hands out the next range of j, false once its space is exhausted.
+// Ranges end where the offsets wrap so that each is contiguous.
+func (a *nonceAllocator) take(j *jobSpace) (czzhash.NonceRange, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if j.done {
+		return czzhash.NonceRange{}, false
+	}
+	offset := (j.base + j.next) & j.mask
+	// counts less one, so that a whole 64 bit space does not overflow
+	n := a.size - 1
+	if left := j.mask - j.next; n > left {
+		n = left
+	}
+	if end := j.mask - offset; n > end {
+		n = end
+	}
+	if n == j.mask-j.next {
+		j.done = true
+	} else {
+		j.next += n + 1
+	}
+	return czzhash.NonceRange{Start: j.prefix | offset, Count: n + 1}, true
+}
+
+// hashed records that the devices hashed n nonces of j.
+func (a *nonceAllocator) hashed(j *jobSpace, n uint64) {
+	a.mu.Lock()
+	j.hashed += n
+	a.mu.Unlock()
+}
+
+// exhausted reports whether every range of j was handed out.
+func (a *nonceAllocator) exhausted(j *jobSpace) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return j.done
+}
+
+// report logs how much of the space of j was hashed.
+func (a *nonceAllocator) report(j *jobSpace) {
+	a.mu.Lock()
+	hashed, coverage := j.hashed, j.coverage()
+	a.mu.Unlock()
+	log.Println("Job coverage", "id:", j.key.id, "hashed:", hashed, "coverage:", fmt.Sprintf("%.4f%%", 100*coverage))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/classzz/miner-gpu/czzhash"
+)
+
+// takeAll takes the ranges of j until its space is exhausted.
+func takeAll(t *testing.T, a *nonceAllocator, j *jobSpace) []czzhash.NonceRange {
+	var ranges []czzhash.NonceRange
+	for {
+		r, ok := a.take(j)
+		if !ok {
+			return ranges
+		}
+		if r.Count == 0 {
+			t.Fatalf("empty range at %#x", r.Start)
+		}
+		ranges = append(ranges, r)
+		if len(ranges) > 1<<16 {
+			t.Fatal("space never exhausted")
+		}
+	}
+}
+
+func TestNonceTakeCoversSpace(t *testing.T) {
+	a, err := newNonceAllocator(0, 0, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &Work{ID: "1", NoncePrefix: 0xab00, NonceMask: 0xff}
+	j, err := a.job(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the ranges past the end of the offsets start over at 0
+	j.base = 0xf5
+
+	seen := make(map[uint64]bool)
+	for _, r := range takeAll(t, a, j) {
+		first, last := r.Start, r.Start+r.Count-1
+		if first&^w.NonceMask != w.NoncePrefix || last&^w.NonceMask != w.NoncePrefix || last < first {
+			t.Fatalf("range %#x+%d leaves the space of prefix %#x", r.Start, r.Count, w.NoncePrefix)
+		}
+		if r.Count > 16 {
+			t.Fatalf("range %#x+%d larger than 16", r.Start, r.Count)
+		}
+		for n := first; n <= last; n++ {
+			if seen[n] {
+				t.Fatalf("nonce %#x handed out twice", n)
+			}
+			seen[n] = true
+		}
+	}
+	if len(seen) != 0x100 {
+		t.Fatalf("%d of 256 nonces handed out", len(seen))
+	}
+	if !a.exhausted(j) {
+		t.Fatal("space not exhausted")
+	}
+}
+
+func TestNonceTakeRig(t *testing.T) {
+	a, err := newNonceAllocator(5, 4, 1<<8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &Work{ID: "1", NoncePrefix: 0x77 << 16, NonceMask: 0xffff}
+	j, err := a.job(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.base = 0
+	ranges := takeAll(t, a, j)
+	if len(ranges) != 0x1000>>8 {
+		t.Fatalf("%d ranges, want %d", len(ranges), 0x1000>>8)
+	}
+	for _, r := range ranges {
+		for _, n := range []uint64{r.Start, r.Start + r.Count - 1} {
+			if n>>16 != 0x77 || n>>12&0xf != 5 {
+				t.Fatalf("nonce %#x outside the space of rig 5 under prefix 0x77", n)
+			}
+		}
+	}
+}
+
+func TestNonceTakeFullSpace(t *testing.T) {
+	a, err := newNonceAllocator(0, 0, 1<<62)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := a.job(&Work{ID: "1", NonceMask: ^uint64(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.base = 1 << 61
+	var total uint64
+	ranges := takeAll(t, a, j)
+	for _, r := range ranges {
+		total += r.Count
+	}
+	// the offset the space starts at splits one range at 2^64
+	if len(ranges) != 5 || total != 0 {
+		t.Fatalf("%d ranges of %d nonces in total, want 5 covering 2^64", len(ranges), total)
+	}
+}
+
+func TestNonceJob(t *testing.T) {
+	a, err := newNonceAllocator(0, 0, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &Work{ID: "1", NoncePrefix: 0x100, NonceMask: 0xff}
+	j1, _ := a.job(w)
+	j2, _ := a.job(&Work{ID: "1", NoncePrefix: 0x100, NonceMask: 0xff})
+	if j1 != j2 {
+		t.Fatal("the same job got a second space")
+	}
+	j3, _ := a.job(&Work{ID: "1", NoncePrefix: 0x200, NonceMask: 0xff})
+	if j3 == j1 {
+		t.Fatal("a new extranonce1 did not open a new space")
+	}
+
+	a, _ = newNonceAllocator(1, 8, 16)
+	if _, err := a.job(w); err == nil {
+		t.Fatal("rig id of 8 bits accepted in a space of 8 bits")
+	}
+}
+
+func TestNewNonceAllocator(t *testing.T) {
+	for _, tt := range []struct {
+		rig     uint64
+		rigBits uint
+		size    uint64
+		ok      bool
+	}{
+		{0, 0, 1, true},
+		{15, 4, 1 << 24, true},
+		{16, 4, 1 << 24, false},
+		{0, 33, 1 << 24, false},
+		{0, 0, 0, false},
+	} {
+		_, err := newNonceAllocator(tt.rig, tt.rigBits, tt.size)
+		if (err == nil) != tt.ok {
+			t.Errorf("newNonceAllocator(%d, %d, %d): err %v", tt.rig, tt.rigBits, tt.size, err)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/classzz/miner-gpu/czzhash"
+)
+
+// job is work published to the devices together with its nonce space and
+// the table of its epoch.
+type job struct {
+	work   *Work
+	space  *jobSpace
+	bin    *czzhash.Csatable // the table of the epoch of the work
+	hasher *czzhash.Hasher   // of bin, to verify the shares of the job
+	done   chan struct{}     // closed once the job is replaced, stops its searches
+}
+
+// same reports whether w continues j, so the devices can keep hashing it.
+func (j *job) same(w *Work, space *jobSpace, bin *czzhash.Csatable) bool {
+	return j.space == space && j.bin == bin && j.work.Header == w.Header && j.work.Target.Cmp(w.Target) == 0 &&
+		j.work.src == w.src && j.work.Stale == w.Stale
+}
+
+// publish makes j the job of the devices, nil leaves them without one. The
+// searches on the replaced job stop.
+func (m *Miner) publish(j *job) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.job != nil {
+		close(m.job.done)
+	}
+	m.job = j
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// current returns the published job.
+func (m *Miner) current() *job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.job
+}
+
+// nextJob waits for a job other than prev to be published. It returns nil
+// once Quit is closed or fetch returned.
+func (m *Miner) nextJob(prev *job) *job {
+	for {
+		m.mu.Lock()
+		j, changed := m.job, m.changed
+		m.mu.Unlock()
+		if j != nil && j != prev {
+			return j
+		}
+		select {
+		case <-changed:
+		case <-m.Quit:
+			return nil
+		case <-m.stop:
+			return nil
+		}
+	}
+}
+
+// requestWork asks fetch for new work without waiting for it.
+func (m *Miner) requestWork() {
+	select {
+	case m.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// fetch gets work and publishes it until Quit is closed or out is closed
+// because every device is out. New work is fetched when the current work
+// goes stale, when a device found a share or ran out of nonces, so the
+// devices only wait for the RPC round-trip once their job is over.
+func (m *Miner) fetch(out <-chan struct{}) error {
+	var last *jobSpace
+	for {
+		select {
+		case <-m.Quit:
+			return nil
+		case <-out:
+			select {
+			case <-m.Quit:
+				return nil
+			default:
+			}
+			return fmt.Errorf("all devices quarantined or disabled")
+		default:
+		}
+
+		work, err := m.Source.GetWork()
+		if err != nil {
+			select {
+			case <-m.Quit:
+				return nil
+			default:
+			}
+			return fmt.Errorf("GetWork: %v", err)
+		}
+
+		space, err := m.Nonces.job(work)
+		if err != nil {
+			return err
+		}
+		if space != last {
+			if last != nil {
+				m.Nonces.report(last)
+			}
+			last = space
+		}
+
+		// work without a height is hashed with the table of the last work
+		if work.Height != 0 {
+			bin, err := m.Cl.Update(work.Height)
+			if err != nil {
+				return fmt.Errorf("Update: %v", err)
+			}
+			if bin != m.bin {
+				m.bin, m.hasher = bin, czzhash.NewHasher(bin)
+			}
+		}
+
+		if m.Nonces.exhausted(space) {
+			// nothing left to hash until the source has new work or the pool
+			// a new extranonce
+			log.Println("Nonce space exhausted", "id:", work.ID)
+			select {
+			case <-work.Stale:
+			case <-time.After(time.Second):
+			case <-m.Quit:
+			}
+			continue
+		}
+		if cur := m.current(); cur == nil || !cur.same(work, space, m.bin) {
+			m.publish(&job{work: work, space: space, bin: m.bin, hasher: m.hasher, done: make(chan struct{})})
+		}
+
+		select {
+		case <-work.Stale:
+			log.Println("Stale work", "id:", work.ID)
+			m.publish(nil)
+		case <-m.refresh:
+		case <-m.Quit:
+		case <-out:
+		}
+	}
+}
+
+// device runs the search loop of device id: it hashes the ranges of the
+// current job one after the other, switching jobs as they are published,
+// until Quit is closed, fetch returned or the device is quarantined or
+// disabled.
+func (m *Miner) device(id czzhash.DeviceID) {
+	var j *job
+	for {
+		if m.Verifier.Quarantined(id) || m.Supervisor.Disabled(id) {
+			return
+		}
+		select {
+		case <-m.Quit:
+			return
+		case <-m.stop:
+			return
+		default:
+		}
+		if j == nil || isClosed(j.done) {
+			if j = m.nextJob(j); j == nil {
+				return
+			}
+		}
+
+		nonces, ok := m.Nonces.take(j.space)
+		if !ok {
+			m.requestWork()
+			select {
+			case <-j.done:
+			case <-m.Quit:
+			}
+			continue
+		}
+		m.search(j, nonces, id)
+	}
+}
+
+// search hashes nonces of j on device id. After a share the search goes on
+// with the rest of the range, after the nonces the device hashed, so shares
+// at pool difficulty waste no nonces and none is hashed twice.
+func (m *Miner) search(j *job, nonces czzhash.NonceRange, id czzhash.DeviceID) {
+	for nonces.Count > 0 {
+		r, err := m.Cl.Search(j.work.Header, j.work.Target, j.bin, nonces, j.done, id)
+		if err != nil {
+			// reset on this goroutine, so that Close waits for it
+			m.Supervisor.Failed(id, err)
+			return
+		}
+		m.Supervisor.Succeeded(id)
+		m.Nonces.hashed(j.space, r.Nonces)
+		if len(r.Found) == 0 {
+			return
+		}
+		for _, nonce := range r.Found {
+			m.found(j, id, nonce)
+		}
+		if r.Nonces >= nonces.Count {
+			return
+		}
+		nonces.Start += r.Nonces
+		nonces.Count -= r.Nonces
+	}
+}
+
+// found checks a nonce device id found for j on the host and submits it.
+func (m *Miner) found(j *job, id czzhash.DeviceID, nonce uint64) {
+	// never trust the device, rehash the nonce on the host with the table
+	// of the job, which the devices may have moved on from
+	if !m.Verifier.Verify(id, j.hasher, j.work.Header, nonce, j.work.Target) {
+		stats := m.Verifier.Stats(id)
+		log.Println("Hardware error", "device:", id, "nonce:", nonce,
+			"errors:", stats.HardwareErrors, "accepted:", stats.Accepted)
+		if stats.Quarantined {
+			log.Println("Device quarantined", "device:", id)
+		}
+		return
+	}
+	m.SubmitWorkAsync(j.work, nonce)
+	// a block found on a node makes the work obsolete, a pool may have a
+	// new job; fetch keeps the job if it did not change
+	m.requestWork()
+}
+
+// submission is a nonce sent upstream whose answer is still to come.
+type submission struct {
+	work   *Work
+	nonce  uint64
+	result SubmitFuture
+}
+
+// SubmitWorkAsync sends nonce upstream right away and leaves its answer to
+// submitter, the devices keep hashing meanwhile.
+func (m *Miner) SubmitWorkAsync(w *Work, nonce uint64) {
+	log.Println("SubmitWork", "Nonce:", nonce, "hashrate:", formatRate(m.Cl.Metrics().HashRate(czzhash.RateWindows[1])))
+	m.submits <- submission{work: w, nonce: nonce, result: m.Source.SubmitWorkAsync(w, nonce)}
+}
+
+// submitter waits for the answers to the nonces submitted, in the order they
+// were sent, and has the supervisor retry those that did not get through. It
+// returns once submits is closed.
+func (m *Miner) submitter() {
+	for s := range m.submits {
+		err := m.Supervisor.Submit(m.Source, s.work, s.nonce, s.result)
+		if err == nil {
+			continue
+		}
+		if permanent(err) {
+			log.Println("Share rejected", "id:", s.work.ID, "nonce:", s.nonce, "err:", err)
+			continue
+		}
+		log.Println("SubmitWork", "err", err)
+	}
+}
+
+// isClosed reports whether ch is closed.
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
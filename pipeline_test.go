@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/classzz/miner-gpu/czzhash"
+)
+
+// testSearcher is a backend whose devices hash every nonce without finding
+// any. Update returns the table of the height in tables, Search records the
+// table it was given for each header.
+type testSearcher struct {
+	devices []czzhash.DeviceID
+	metrics *czzhash.Metrics
+	tables  map[uint64]*czzhash.Csatable
+
+	mu       sync.Mutex
+	searched map[[32]byte]*czzhash.Csatable
+}
+
+func newTestSearcher(devices ...czzhash.DeviceID) *testSearcher {
+	return &testSearcher{devices: devices, metrics: czzhash.NewMetrics(), searched: make(map[[32]byte]*czzhash.Csatable)}
+}
+
+func (s *testSearcher) Init(blockNum uint64) error { return nil }
+
+func (s *testSearcher) Search(hash [32]byte, target *big.Int, tbl *czzhash.Csatable, nonces czzhash.NonceRange, stop <-chan struct{}, id czzhash.DeviceID) (*czzhash.Result, error) {
+	s.mu.Lock()
+	s.searched[hash] = tbl
+	s.mu.Unlock()
+	select {
+	case <-stop:
+		return &czzhash.Result{}, nil
+	case <-time.After(time.Millisecond):
+	}
+	s.metrics.Add(id, nonces.Count)
+	return &czzhash.Result{Nonces: nonces.Count}, nil
+}
+
+func (s *testSearcher) Reset(id czzhash.DeviceID) error { return nil }
+func (s *testSearcher) Update(blockNum uint64) (*czzhash.Csatable, error) {
+	return s.tables[blockNum], nil
+}
+
+func (s *testSearcher) Devices() []czzhash.DeviceID { return s.devices }
+func (s *testSearcher) Metrics() *czzhash.Metrics   { return s.metrics }
+func (s *testSearcher) Bin() *czzhash.Csatable      { return nil }
+func (s *testSearcher) Close() error                { return nil }
+
+// testSource hands out works jobs, then fails. The header of a job is its
+// index, as is its ID, its height the one at the index in heights if there
+// is one.
+type testSource struct {
+	mu      sync.Mutex
+	works   int
+	heights []uint64
+	next    int
+	err     error
+}
+
+func (s *testSource) GetWork() (*Work, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.works == 0 {
+		return nil, s.err
+	}
+	s.works--
+	w := &Work{ID: strconv.Itoa(s.next), Target: big.NewInt(1), NonceMask: 0xfff}
+	w.Header[0] = byte(s.next)
+	if s.next < len(s.heights) {
+		w.Height = s.heights[s.next]
+	}
+	s.next++
+	return w, nil
+}
+
+func (s *testSource) SubmitWorkAsync(w *Work, nonce uint64) SubmitFuture {
+	r := make(submitResult, 1)
+	r <- nil
+	return r
+}
+
+func (s *testSource) Close() {}
+
+func newTestMiner(t *testing.T, source WorkSource, cl czzhash.Searcher) *Miner {
+	nonces, err := newNonceAllocator(0, 0, 1<<8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quit := make(chan struct{})
+	return &Miner{
+		Source:     source,
+		Cl:         cl,
+		Verifier:   czzhash.NewVerifier(0.1, 5),
+		Supervisor: newSupervisor(cl, quit),
+		Nonces:     nonces,
+		Quit:       quit,
+	}
+}
+
+// TestMiningGetWorkFails checks that mining returns the error of GetWork
+// and that the device loops and the submitter end, whether GetWork fails
+// right away or once the devices are mining.
+func TestMiningGetWorkFails(t *testing.T) {
+	for _, works := range []int{0, 1} {
+		failed := errors.New("no work")
+		m := newTestMiner(t, &testSource{works: works, err: failed}, newTestSearcher("a", "b"))
+
+		done := make(chan error, 1)
+		go func() {
+			err := m.mining()
+			m.CancelWg.Wait()
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err == nil || err.Error() != "GetWork: "+failed.Error() {
+				t.Fatalf("%d works: mining returned %v, want the GetWork error", works, err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%d works: mining did not end after GetWork failed", works)
+		}
+	}
+}
+
+// TestMiningSearchesWithTableOfWork checks that the devices hash each job
+// with the table of its own height, also when the table of a later epoch
+// was loaded before it.
+func TestMiningSearchesWithTableOfWork(t *testing.T) {
+	old, cur := czzhash.NewCsatable(), czzhash.NewCsatable()
+	cl := newTestSearcher("a")
+	cl.tables = map[uint64]*czzhash.Csatable{1: old, 2: cur}
+	heights := []uint64{2, 1}
+	m := newTestMiner(t, &testSource{works: len(heights), heights: heights, err: errors.New("no work")}, cl)
+
+	m.mining()
+	m.CancelWg.Wait()
+	for i, height := range heights {
+		var header [32]byte
+		header[0] = byte(i)
+		tbl, ok := cl.searched[header]
+		if !ok {
+			t.Fatalf("job %d was not searched", i)
+		}
+		if tbl != cl.tables[height] {
+			t.Errorf("job %d at height %d searched with the table of another height", i, height)
+		}
+	}
+}
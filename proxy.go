@@ -0,0 +1,181 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/classzz/classzz/rpcclient"
+	"github.com/classzz/miner-gpu/czzhash"
+	"github.com/classzz/miner-gpu/stratum"
+)
+
+// proxy polls a single node for work and serves it to many miners over
+// stratum. Every connection mines its own part of the nonce space, shares are
+// checked with the CPU hash and block solutions are submitted to the node.
+func proxy(args []string) {
+	fs := flag.NewFlagSet("proxy", flag.ExitOnError)
+	var HostFlag = fs.String("h", "127.0.0.1:8334", "rpcclient Host ")
+	var UserFlag = fs.String("u", "", "User")
+	var PassFlag = fs.String("p", "", "Pass")
+	var ListenFlag = fs.String("listen", "0.0.0.0:3333", "Address to serve stratum on")
+	var PollFlag = fs.Duration("poll", time.Second, "Interval between GetWork calls to the node")
+	var DifficultyFlag = fs.Float64("difficulty", 1, "Share difficulty sent to miners")
+	var ExtranonceFlag = fs.Int("extranonce", 2, "Nonce bytes fixed per connection, 2^(8*n) miners can be connected at a time")
+	table := tableFlags(fs)
+	fs.Parse(args)
+
+	client, err := dialNode(*HostFlag, *UserFlag, *PassFlag)
+	if err != nil {
+		log.Fatal("rpcclient", "err", err)
+	}
+	defer client.Shutdown()
+
+	p := &proxyPool{
+		client: client,
+		pow:    czzhash.NewTable(table()),
+	}
+	if err = p.setTable(0); err != nil {
+		log.Fatal("GetBin", "err", err)
+	}
+	p.server = stratum.NewServer(p, *ExtranonceFlag)
+	p.server.SetDifficulty(*DifficultyFlag)
+
+	l, err := net.Listen("tcp", *ListenFlag)
+	if err != nil {
+		log.Fatal("listen", "err", err)
+	}
+	log.Println("Proxy", "listen:", l.Addr(), "node:", *HostFlag, "difficulty:", *DifficultyFlag)
+	go p.poll(*PollFlag)
+
+	if err = p.server.Serve(l); err != nil {
+		log.Fatal("Serve", "err", err)
+	}
+}
+
+// proxyJob is the work of one GetWork result.
+type proxyJob struct {
+	id     string
+	hash   string // as returned by GetWork, for SubmitWork
+	header czzhash.Hash
+	target *big.Int // block target
+	hasher *czzhash.Hasher
+	shares map[uint64]bool
+}
+
+// proxyPool is the stratum.Handler of the proxy. Only the newest job is
+// mined, jobs are always announced clean.
+type proxyPool struct {
+	client *rpcclient.Client
+	pow    *czzhash.CzzHash
+	server *stratum.Server
+
+	mu     sync.Mutex // protects the fields below
+	bin    *czzhash.Csatable
+	hasher *czzhash.Hasher // for the table bin
+	job    *proxyJob
+	seq    uint64
+}
+
+// setTable switches to the table of the epoch of height.
+func (p *proxyPool) setTable(height uint64) error {
+	bin, err := p.pow.GetBin(height)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	if bin != p.bin {
+		p.bin, p.hasher = bin, czzhash.NewHasher(bin)
+	}
+	p.mu.Unlock()
+	return nil
+}
+
+// poll fetches work from the node and announces it whenever it changes.
+func (p *proxyPool) poll(interval time.Duration) {
+	for {
+		if err := p.update(); err != nil {
+			log.Println("GetWork", "err", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (p *proxyPool) update() error {
+	work, err := p.client.GetWork()
+	if err != nil {
+		return err
+	}
+	target, err := czzhash.ParseTarget(work.Target)
+	if err != nil {
+		return err
+	}
+	height := nextHeight(p.client)
+	if height != 0 {
+		if err = p.setTable(height); err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	if p.job != nil && p.job.hash == work.Hash && p.job.target.Cmp(target) == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	p.seq++
+	job := &proxyJob{
+		id:     strconv.FormatUint(p.seq, 16),
+		hash:   work.Hash,
+		target: target,
+		hasher: p.hasher,
+		shares: make(map[uint64]bool),
+	}
+	job.header.SetBytes([]byte(work.Hash))
+	p.job = job
+	p.mu.Unlock()
+
+	log.Println("GetWork", "job:", job.id, "Hash", work.Hash, "Target", work.Target, "miners:", p.server.Sessions())
+	p.server.Notify(job.id, job.header, height, true)
+	return nil
+}
+
+// Authorize accepts every worker, the proxy is meant for one's own rigs.
+func (p *proxyPool) Authorize(s *stratum.Session, user, pass string) bool {
+	log.Println("Authorize", "addr:", s.Addr, "user:", user)
+	return true
+}
+
+// Submit checks a share and passes block solutions on to the node.
+func (p *proxyPool) Submit(s *stratum.Session, user, jobID string, nonce uint64) error {
+	p.mu.Lock()
+	job := p.job
+	if job == nil || job.id != jobID {
+		p.mu.Unlock()
+		return &stratum.Error{Code: stratum.CodeJobNotFound, Message: "stale job"}
+	}
+	if job.shares[nonce] {
+		p.mu.Unlock()
+		return &stratum.Error{Code: stratum.CodeDuplicate, Message: "duplicate share"}
+	}
+	job.shares[nonce] = true
+	p.mu.Unlock()
+
+	value := czzhash.HashToBig(job.hasher.Hash(job.header, nonce))
+	if value.Cmp(job.target) <= 0 {
+		log.Println("SubmitWork", "job:", job.id, "user:", user, "Nonce:", nonce)
+		if err := p.client.SubmitWork(job.hash, nonce); err != nil {
+			log.Println("SubmitWork", "err", err)
+		}
+		return nil
+	}
+	if value.Cmp(stratum.DifficultyToTarget(p.server.Difficulty())) > 0 {
+		log.Println("Share rejected", "addr:", s.Addr, "user:", user, "job:", job.id, "nonce:", nonce)
+		return &stratum.Error{Code: stratum.CodeLowDifficulty, Message: "low difficulty share"}
+	}
+	log.Println("Share accepted", "addr:", s.Addr, "user:", user, "job:", job.id, "nonce:", nonce)
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/classzz/classzz/chaincfg/chainhash"
+	"github.com/classzz/miner-gpu/czzhash"
+	"golang.org/x/crypto/sha3"
+)
+
+// selftest checks chainhash.HashCZZ, the CPU backend and optionally the OpenCL
+// kernel against czzhash.Vectors, and Hasher against chainhash.HashCZZ with
+// the table mining would use if there is one. It exits non-zero on any
+// mismatch.
+func selftest(args []string) {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	var OpenCLFlag = fs.Bool("opencl", false, "Also run the vectors through the OpenCL kernel on every device")
+	var TableFlag = fs.String("table", "", "Table to check Hasher against chainhash.HashCZZ with (default as for mining), skipped if it does not exist")
+	fs.Parse(args)
+
+	failed := false
+	report := func(name string, n int, err error) {
+		if err != nil {
+			failed = true
+			log.Println("selftest", name, "FAIL", "checked:", n, "err:", err)
+			return
+		}
+		log.Println("selftest", name, "ok", "checked:", n)
+	}
+
+	n, err := verifyChainhash()
+	report("chainhash.HashCZZ", n, err)
+
+	n, err = czzhash.VerifyCPU()
+	report("cpu", n, err)
+
+	path := czzhash.TablePath(*TableFlag)
+	if _, err := os.Stat(path); err == nil {
+		n, err = verifyTable(path)
+		report(path, n, err)
+	} else {
+		log.Println("selftest", "no table, skipped", "path:", path)
+	}
+
+	if *OpenCLFlag {
+		results, err := czzhash.VerifyVectorsCL()
+		if err != nil {
+			report("opencl", 0, err)
+		}
+		for _, r := range results {
+			report(r.Device, r.Checked, r.Err)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// verifyChainhash checks the vectors of every table seed against
+// chainhash.HashCZZ.
+func verifyChainhash() (int, error) {
+	dir, err := ioutil.TempDir("", "czzhash-selftest")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	checked := 0
+	for i := 0; i < len(czzhash.Vectors); {
+		seed := czzhash.Vectors[i].TableSeed
+		j := i
+		for j < len(czzhash.Vectors) && czzhash.Vectors[j].TableSeed == seed {
+			j++
+		}
+		path := filepath.Join(dir, seed+".bin")
+		if err := ioutil.WriteFile(path, czzhash.TestTable(seed).Bytes(), 0644); err != nil {
+			return checked, err
+		}
+		results, err := hashCZZ(path, czzhash.Vectors[i:j])
+		if err != nil {
+			return checked, err
+		}
+		for k, r := range results {
+			if v := czzhash.Vectors[i+k]; r.Result != v.Result {
+				return checked, fmt.Errorf("vector %d (seed %q, nonce %#x): got %s, want %s", i+k, seed, v.Nonce, r.Result, v.Result)
+			}
+			checked++
+		}
+		i = j
+	}
+	return checked, nil
+}
+
+// verifyTable checks Hasher against chainhash.HashCZZ with the table at
+// path, such as the table of a network, on a few headers. There are no
+// published results for those tables, so both have to agree instead.
+func verifyTable(path string) (int, error) {
+	tbl, err := czzhash.LoadTable(path, "")
+	if err != nil {
+		return 0, err
+	}
+	hasher := czzhash.NewHasher(tbl)
+	var vectors []czzhash.Vector
+	for i := uint64(0); i < 4; i++ {
+		header := czzhash.Hash(sha3.Sum256([]byte(fmt.Sprintf("czzhash-selftest-%d", i))))
+		result := hasher.Hash(header, i*0x9e3779b97f4a7c15)
+		vectors = append(vectors, czzhash.Vector{
+			Header: hex.EncodeToString(header[:]),
+			Nonce:  i * 0x9e3779b97f4a7c15,
+			Result: hex.EncodeToString(result[:]),
+		})
+	}
+
+	results, err := hashCZZ(path, vectors)
+	if err != nil {
+		return 0, err
+	}
+	for i, r := range results {
+		if v := vectors[i]; r.Result != v.Result {
+			return i, fmt.Errorf("header %s nonce %#x: chainhash.HashCZZ got %s, Hasher %s", v.Header, v.Nonce, r.Result, v.Result)
+		}
+	}
+	return len(results), nil
+}
+
+// hashCZZ returns vectors with their Result computed by chainhash.HashCZZ
+// with the table at path. HashCZZ loads csatable.bin from the working
+// directory once per process, so the hashczz command computes them in a
+// process of its own, started in a directory holding a link to the table.
+func hashCZZ(path string, vectors []czzhash.Vector) ([]czzhash.Vector, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "czzhash-selftest")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Symlink(path, filepath.Join(dir, czzhash.TableFile)); err != nil {
+		return nil, err
+	}
+
+	in, err := json.Marshal(vectors)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(exe, "hashczz")
+	cmd.Dir = dir
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("hashczz: %v", err)
+	}
+	var results []czzhash.Vector
+	if err := json.Unmarshal(out, &results); err != nil {
+		return nil, fmt.Errorf("hashczz: %v", err)
+	}
+	if len(results) != len(vectors) {
+		return nil, fmt.Errorf("hashczz returned %d of %d results", len(results), len(vectors))
+	}
+	return results, nil
+}
+
+// hashczz reads vectors as JSON from stdin, sets their Result to what
+// chainhash.HashCZZ returns with csatable.bin in the working directory and
+// writes them as JSON to stdout. It is run by selftest.
+func hashczz(args []string) {
+	var vectors []czzhash.Vector
+	if err := json.NewDecoder(os.Stdin).Decode(&vectors); err != nil {
+		log.Fatal("hashczz", "err", err)
+	}
+	for i := range vectors {
+		header, err := hex.DecodeString(vectors[i].Header)
+		if err != nil {
+			log.Fatal("hashczz", "err", err)
+		}
+		res := chainhash.HashCZZ(header, vectors[i].Nonce)
+		if res == nil {
+			log.Fatal("HashCZZ failed to load the table")
+		}
+		vectors[i].Result = hex.EncodeToString(res)
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(vectors); err != nil {
+		log.Fatal("hashczz", "err", err)
+	}
+}
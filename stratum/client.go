@@ -0,0 +1,337 @@
+package stratum
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned for calls on a closed Client.
+var ErrClosed = errors.New("stratum: connection closed")
+
+// call is a request waiting for its response.
+type call struct {
+	method string
+	result json.RawMessage
+	err    error
+	done   chan struct{}
+}
+
+// Client is a stratum v1 mining client.
+type Client struct {
+	conn net.Conn
+
+	wmu sync.Mutex // protects enc
+	enc *json.Encoder
+
+	mu              sync.Mutex // protects the fields below
+	nextID          uint64
+	pending         map[uint64]*call
+	extranonce1     []byte
+	extranonce2Size int
+	difficulty      float64
+	job             *Job // the last one pushed, again with a new extranonce1
+	err             error
+
+	jobs   chan *Job
+	closed chan struct{}
+}
+
+// Dial connects to a stratum server. addr may carry a stratum+tcp:// prefix.
+func Dial(addr string) (*Client, error) {
+	addr = strings.TrimPrefix(addr, "stratum+tcp://")
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// NewClient runs the protocol over an established connection.
+func NewClient(conn net.Conn) *Client {
+	c := &Client{
+		conn:       conn,
+		enc:        json.NewEncoder(conn),
+		pending:    make(map[uint64]*call),
+		difficulty: 1,
+		jobs:       make(chan *Job, 1),
+		closed:     make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+// Jobs delivers the newest job. Jobs that were not picked up in time are
+// replaced, so a receiver always gets the current one.
+func (c *Client) Jobs() <-chan *Job {
+	return c.jobs
+}
+
+// Done is closed when the connection is gone, Err tells why.
+func (c *Client) Done() <-chan struct{} {
+	return c.closed
+}
+
+// Err returns the error that closed the connection.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = ErrClosed
+	}
+	c.mu.Unlock()
+	return c.conn.Close()
+}
+
+// Subscribe sends mining.subscribe and records the extranonce assigned by the
+// server.
+func (c *Client) Subscribe(agent string) error {
+	_, err := c.call("mining.subscribe", agent)
+	return err
+}
+
+// subscribed records the extranonce of a subscribe result. It runs on the
+// read loop so that jobs notified right after the response already use it.
+func (c *Client) subscribed(res json.RawMessage) error {
+	var result []json.RawMessage
+	if err := json.Unmarshal(res, &result); err != nil || len(result) < 3 {
+		return fmt.Errorf("stratum: malformed subscribe result %s", res)
+	}
+	var e1 string
+	var e2size int
+	if err := json.Unmarshal(result[1], &e1); err != nil {
+		return fmt.Errorf("stratum: extranonce1: %v", err)
+	}
+	if err := json.Unmarshal(result[2], &e2size); err != nil {
+		return fmt.Errorf("stratum: extranonce2_size: %v", err)
+	}
+	return c.setExtranonce(e1, e2size)
+}
+
+// SubscribeExtranonce sends mining.extranonce.subscribe, asking the server to
+// announce extranonce changes with mining.set_extranonce. Servers that do not
+// support them answer with an error.
+func (c *Client) SubscribeExtranonce() error {
+	_, err := c.call("mining.extranonce.subscribe")
+	return err
+}
+
+// Authorize sends mining.authorize for a worker.
+func (c *Client) Authorize(user, pass string) error {
+	res, err := c.call("mining.authorize", user, pass)
+	if err != nil {
+		return err
+	}
+	var ok bool
+	if err := json.Unmarshal(res, &ok); err != nil || !ok {
+		return fmt.Errorf("stratum: worker %s not authorized", user)
+	}
+	return nil
+}
+
+// Submit sends a share found for job. A rejected share is returned as *Error.
+func (c *Client) Submit(user string, job *Job, nonce uint64) error {
+	res, err := c.call("mining.submit", user, job.ID, hex.EncodeToString(job.Extranonce2(nonce)))
+	if err != nil {
+		return err
+	}
+	var ok bool
+	if err := json.Unmarshal(res, &ok); err != nil || !ok {
+		return &Error{Code: CodeOther, Message: "share rejected"}
+	}
+	return nil
+}
+
+// call sends a request and waits for its response.
+func (c *Client) call(method string, params ...interface{}) (json.RawMessage, error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.nextID++
+	id := c.nextID
+	cl := &call{method: method, done: make(chan struct{})}
+	c.pending[id] = cl
+	c.mu.Unlock()
+
+	if err := c.send(&Request{ID: id, Method: method, Params: params}); err != nil {
+		return nil, err
+	}
+	select {
+	case <-cl.done:
+		return cl.result, cl.err
+	case <-c.closed:
+		return nil, c.Err()
+	case <-time.After(30 * time.Second):
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return nil, fmt.Errorf("stratum: %s timed out", method)
+	}
+}
+
+func (c *Client) send(v interface{}) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.enc.Encode(v)
+}
+
+func (c *Client) readLoop() {
+	dec := json.NewDecoder(bufio.NewReader(c.conn))
+	var err error
+	for {
+		var msg message
+		if err = dec.Decode(&msg); err != nil {
+			break
+		}
+		if msg.Method != "" {
+			if err = c.handle(&msg); err != nil {
+				break
+			}
+			continue
+		}
+		var id uint64
+		if json.Unmarshal(msg.ID, &id) != nil {
+			continue
+		}
+		c.mu.Lock()
+		cl, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if !ok {
+			continue
+		}
+		if msg.Error != nil {
+			cl.err = msg.Error
+		} else {
+			cl.result = msg.Result
+			if cl.method == "mining.subscribe" {
+				cl.err = c.subscribed(msg.Result)
+			}
+		}
+		close(cl.done)
+	}
+
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = fmt.Errorf("stratum: %v", err)
+	}
+	c.mu.Unlock()
+	c.conn.Close()
+	close(c.closed)
+}
+
+// handle processes a notification from the server.
+func (c *Client) handle(msg *message) error {
+	var params []json.RawMessage
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		return fmt.Errorf("%s: %v", msg.Method, err)
+	}
+	switch msg.Method {
+	case "mining.notify":
+		if len(params) < 3 {
+			return fmt.Errorf("mining.notify: %d params", len(params))
+		}
+		var id, header string
+		var clean bool
+		json.Unmarshal(params[0], &id)
+		json.Unmarshal(params[1], &header)
+		json.Unmarshal(params[2], &clean)
+		var height uint64
+		if len(params) > 3 {
+			json.Unmarshal(params[3], &height)
+		}
+		h, err := decodeHex(header, 32)
+		if err != nil {
+			return fmt.Errorf("mining.notify: header: %v", err)
+		}
+
+		c.mu.Lock()
+		job := &Job{
+			ID:              id,
+			Clean:           clean,
+			Height:          height,
+			Target:          DifficultyToTarget(c.difficulty),
+			Extranonce1:     c.extranonce1,
+			Extranonce2Size: c.extranonce2Size,
+		}
+		copy(job.Header[:], h)
+		c.job = job
+		c.mu.Unlock()
+		c.push(job)
+
+	case "mining.set_difficulty":
+		var d float64
+		if len(params) < 1 || json.Unmarshal(params[0], &d) != nil {
+			return fmt.Errorf("mining.set_difficulty: malformed params")
+		}
+		c.mu.Lock()
+		c.difficulty = d
+		c.mu.Unlock()
+
+	case "mining.set_extranonce":
+		var e1 string
+		var e2size int
+		if len(params) < 2 || json.Unmarshal(params[0], &e1) != nil || json.Unmarshal(params[1], &e2size) != nil {
+			return fmt.Errorf("mining.set_extranonce: malformed params")
+		}
+		return c.setExtranonce(e1, e2size)
+	}
+	return nil
+}
+
+func (c *Client) setExtranonce(e1 string, e2size int) error {
+	b, err := decodeHex(e1, -1)
+	if err != nil {
+		return fmt.Errorf("stratum: extranonce1: %v", err)
+	}
+	if len(b)+e2size != NonceSize {
+		return fmt.Errorf("stratum: extranonce sizes %d+%d do not make up a nonce", len(b), e2size)
+	}
+	c.mu.Lock()
+	c.extranonce1, c.extranonce2Size = b, e2size
+	// the current job goes on in the new nonce space; shares of the old one
+	// no longer make up the nonces hashed, so it is stale
+	job := c.job
+	if job != nil {
+		renewed := *job
+		renewed.Clean = true
+		renewed.Target = DifficultyToTarget(c.difficulty)
+		renewed.Extranonce1, renewed.Extranonce2Size = b, e2size
+		job = &renewed
+		c.job = job
+	}
+	c.mu.Unlock()
+	if job != nil {
+		c.push(job)
+	}
+	return nil
+}
+
+// push replaces any job still waiting in c.jobs with job.
+func (c *Client) push(job *Job) {
+	for {
+		select {
+		case c.jobs <- job:
+			return
+		default:
+		}
+		select {
+		case <-c.jobs:
+		default:
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package stratum
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// testPool is the pool end of a connection to a Client.
+type testPool struct {
+	t    *testing.T
+	conn net.Conn
+	dec  *json.Decoder
+	enc  *json.Encoder
+}
+
+func newTestClient(t *testing.T) (*Client, *testPool) {
+	client, pool := net.Pipe()
+	c := NewClient(client)
+	t.Cleanup(func() { c.Close() })
+	return c, &testPool{t: t, conn: pool, dec: json.NewDecoder(bufio.NewReader(pool)), enc: json.NewEncoder(pool)}
+}
+
+// answer reads a request of method and responds with result.
+func (p *testPool) answer(method string, result interface{}) {
+	var req struct {
+		ID     uint64
+		Method string
+	}
+	if err := p.dec.Decode(&req); err != nil {
+		p.t.Fatal(err)
+	}
+	if req.Method != method {
+		p.t.Fatalf("got %s, want %s", req.Method, method)
+	}
+	p.send(&Response{ID: req.ID, Result: result})
+}
+
+func (p *testPool) send(v interface{}) {
+	if err := p.enc.Encode(v); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// subscribe subscribes c, the pool assigning extranonce1.
+func subscribe(t *testing.T, c *Client, p *testPool, extranonce1 string, extranonce2Size int) {
+	done := make(chan error, 1)
+	go func() { done <- c.Subscribe("test") }()
+	p.answer("mining.subscribe", []interface{}{[][]string{{"mining.notify", "1"}}, extranonce1, extranonce2Size})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func nextJob(t *testing.T, c *Client) *Job {
+	select {
+	case job := <-c.Jobs():
+		return job
+	case <-c.Done():
+		t.Fatalf("connection closed: %v", c.Err())
+	case <-time.After(5 * time.Second):
+		t.Fatal("no job")
+	}
+	return nil
+}
+
+func TestClientNotify(t *testing.T) {
+	c, p := newTestClient(t)
+	subscribe(t, c, p, "0a0b", 6)
+
+	p.send(&Request{Method: "mining.set_difficulty", Params: []interface{}{4}})
+	header := "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"
+	p.send(&Request{Method: "mining.notify", Params: []interface{}{"j1", header, true, 42}})
+
+	job := nextJob(t, c)
+	if job.ID != "j1" || !job.Clean || job.Height != 42 || job.Header[1] != 0x11 {
+		t.Fatalf("got job %+v", job)
+	}
+	if job.Target.Cmp(DifficultyToTarget(4)) != 0 {
+		t.Fatalf("target %x, want that of difficulty 4", job.Target)
+	}
+	if job.Nonce(nil) != 0x0a0b<<48 || job.Extranonce2Size != 6 {
+		t.Fatalf("nonce prefix %#x with %d extranonce2 bytes", job.Nonce(nil), job.Extranonce2Size)
+	}
+	if e2 := job.Extranonce2(0x0a0b010203040506); len(e2) != 6 || e2[0] != 1 || e2[5] != 6 {
+		t.Fatalf("extranonce2 %x", e2)
+	}
+}
+
+func TestClientSetExtranonce(t *testing.T) {
+	c, p := newTestClient(t)
+	subscribe(t, c, p, "0a0b", 6)
+
+	header := "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"
+	p.send(&Request{Method: "mining.notify", Params: []interface{}{"j1", header, false, 42}})
+	first := nextJob(t, c)
+
+	// the current job comes again, in the new nonce space
+	p.send(&Request{Method: "mining.set_extranonce", Params: []interface{}{"0c0d0e", 5}})
+	job := nextJob(t, c)
+	if job.ID != first.ID || job.Header != first.Header || job.Height != first.Height {
+		t.Fatalf("got job %+v after set_extranonce, want %+v again", job, first)
+	}
+	if !job.Clean {
+		t.Fatal("job in the new nonce space not clean")
+	}
+	if job.Nonce(nil) != 0x0c0d0e<<40 || job.Extranonce2Size != 5 {
+		t.Fatalf("nonce prefix %#x with %d extranonce2 bytes", job.Nonce(nil), job.Extranonce2Size)
+	}
+	if first.Nonce(nil) != 0x0a0b<<48 {
+		t.Fatalf("set_extranonce changed the job handed out before to %#x", first.Nonce(nil))
+	}
+
+	// later jobs are in the new space as well
+	p.send(&Request{Method: "mining.notify", Params: []interface{}{"j2", header, false, 43}})
+	if job = nextJob(t, c); job.ID != "j2" || job.Clean || job.Nonce(nil) != 0x0c0d0e<<40 {
+		t.Fatalf("got job %+v", job)
+	}
+}
+
+func TestClientSetExtranonceMalformed(t *testing.T) {
+	c, p := newTestClient(t)
+	subscribe(t, c, p, "0a0b", 6)
+
+	// 3+6 bytes do not make up a nonce
+	p.send(&Request{Method: "mining.set_extranonce", Params: []interface{}{"0c0d0e", 6}})
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("malformed set_extranonce accepted")
+	}
+}
+
+func TestClientSubmit(t *testing.T) {
+	c, p := newTestClient(t)
+	subscribe(t, c, p, "0a0b", 6)
+	job := &Job{ID: "j1", Extranonce1: []byte{0x0a, 0x0b}, Extranonce2Size: 6}
+
+	done := make(chan error, 1)
+	go func() { done <- c.Submit("worker", job, 0x0a0b010203040506) }()
+	var req struct {
+		ID     uint64
+		Method string
+		Params []string
+	}
+	if err := p.dec.Decode(&req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != "mining.submit" || len(req.Params) != 3 || req.Params[0] != "worker" || req.Params[1] != "j1" || req.Params[2] != "010203040506" {
+		t.Fatalf("got %s %q", req.Method, req.Params)
+	}
+	p.send(&Response{ID: req.ID, Error: &Error{Code: CodeJobNotFound, Message: "job not found"}})
+	err := <-done
+	if rejected, ok := err.(*Error); !ok || rejected.Code != CodeJobNotFound {
+		t.Fatalf("got %v, want code %d", err, CodeJobNotFound)
+	}
+}
@@ -0,0 +1,171 @@
+// Package stratum implements the stratum v1 mining protocol adapted to
+// czzhash work.
+//
+// Jobs carry the 32 byte header hash instead of coinbase parts, so a job is
+// fully described by its header. The height of the block being mined is
+// optional, it tells the miner which czzhash table epoch the job is in. The
+// 8 byte nonce is split between the pool
+// and the miner: the pool assigns every connection an extranonce1 that forms
+// the big endian high bytes of the nonce, the miner chooses the remaining
+// extranonce2 bytes and submits them. A miner that runs out of extranonce2
+// space waits for the next job or for a new extranonce1, which servers
+// supporting mining.extranonce.subscribe send with mining.set_extranonce.
+// The Client delivers the current job again with the new extranonce1, as a
+// clean job, so the miner moves to the new space right away.
+//
+//	mining.subscribe       ["agent"]            -> [[["mining.notify", id]], extranonce1, extranonce2_size]
+//	mining.authorize       ["user", "pass"]     -> true
+//	mining.extranonce.subscribe []             -> true
+//	mining.submit          ["user", job, e2]    -> true
+//	mining.notify          [job, header, clean, height]
+//	mining.set_difficulty  [difficulty]
+//	mining.set_extranonce  [extranonce1, extranonce2_size]
+package stratum
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// NonceSize is the size of a czzhash nonce in bytes.
+const NonceSize = 8
+
+// Error codes used in responses.
+const (
+	CodeOther         = 20
+	CodeJobNotFound   = 21
+	CodeDuplicate     = 22
+	CodeLowDifficulty = 23
+	CodeUnauthorized  = 24
+	CodeNotSubscribed = 25
+)
+
+// diff1Target is the target of difficulty 1, 2^224 - 1.
+var diff1Target = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 224), big.NewInt(1))
+
+// Error is a stratum error, encoded as [code, message, null].
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("stratum error %d: %s", e.Code, e.Message)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (e *Error) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{e.Code, e.Message, nil})
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Besides the array form some
+// pools send {"code": .., "message": ..}.
+func (e *Error) UnmarshalJSON(b []byte) error {
+	var arr []interface{}
+	if err := json.Unmarshal(b, &arr); err == nil {
+		if len(arr) > 0 {
+			if code, ok := arr[0].(float64); ok {
+				e.Code = int(code)
+			}
+		}
+		if len(arr) > 1 {
+			e.Message, _ = arr[1].(string)
+		}
+		return nil
+	}
+	var obj struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return err
+	}
+	e.Code, e.Message = obj.Code, obj.Message
+	return nil
+}
+
+// Request is a method call, or a notification when ID is nil.
+type Request struct {
+	ID     interface{}   `json:"id"`
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+}
+
+// Response answers the Request with the same ID.
+type Response struct {
+	ID     interface{} `json:"id"`
+	Result interface{} `json:"result"`
+	Error  *Error      `json:"error"`
+}
+
+// message is any incoming line, a request or a response.
+type message struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *Error          `json:"error"`
+}
+
+// Job is a unit of work announced with mining.notify.
+type Job struct {
+	ID     string
+	Header [32]byte
+	Clean  bool   // previous jobs are stale
+	Height uint64 // of the block, 0 if unknown
+
+	Target          *big.Int // from the difficulty in effect
+	Extranonce1     []byte
+	Extranonce2Size int
+}
+
+// Nonce joins extranonce1 and extranonce2 into the nonce that is hashed.
+func (j *Job) Nonce(extranonce2 []byte) uint64 {
+	var b [NonceSize]byte
+	copy(b[:], j.Extranonce1)
+	copy(b[len(j.Extranonce1):], extranonce2)
+	return binary.BigEndian.Uint64(b[:])
+}
+
+// Extranonce2 returns the miner chosen part of nonce.
+func (j *Job) Extranonce2(nonce uint64) []byte {
+	var b [NonceSize]byte
+	binary.BigEndian.PutUint64(b[:], nonce)
+	return b[NonceSize-j.Extranonce2Size:]
+}
+
+// DifficultyToTarget converts a pool difficulty to the target hashes are
+// compared with.
+func DifficultyToTarget(difficulty float64) *big.Int {
+	if difficulty <= 0 {
+		difficulty = 1
+	}
+	t, _ := new(big.Float).Quo(new(big.Float).SetInt(diff1Target), big.NewFloat(difficulty)).Int(nil)
+	if t.Sign() <= 0 {
+		t.SetInt64(1)
+	}
+	return t
+}
+
+// TargetToDifficulty is the inverse of DifficultyToTarget.
+func TargetToDifficulty(target *big.Int) float64 {
+	if target.Sign() <= 0 {
+		return 0
+	}
+	d, _ := new(big.Float).Quo(new(big.Float).SetInt(diff1Target), new(big.Float).SetInt(target)).Float64()
+	return d
+}
+
+func decodeHex(s string, size int) ([]byte, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if size >= 0 && len(b) != size {
+		return nil, fmt.Errorf("%d bytes, want %d", len(b), size)
+	}
+	return b, nil
+}
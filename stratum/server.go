@@ -0,0 +1,304 @@
+package stratum
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+// Handler decides on authorization and shares for a Server.
+type Handler interface {
+	Authorize(s *Session, user, pass string) bool
+	// Submit is called with the full nonce of a share. A non-nil error is
+	// sent back to the miner, use *Error to pick the code.
+	Submit(s *Session, user, jobID string, nonce uint64) error
+}
+
+// Session is one miner connection.
+type Session struct {
+	Extranonce1 []byte
+	Addr        net.Addr
+
+	server *Server
+	conn   net.Conn
+	prefix uint64 // Extranonce1 as a number, returned to the server on close
+
+	wmu sync.Mutex // protects enc
+	enc *json.Encoder
+
+	mu         sync.Mutex // protects the fields below
+	subscribed bool
+	workers    map[string]bool
+}
+
+// Server is a stratum v1 server. Every session gets its own extranonce1 of
+// ExtranonceSize bytes, so miners never hash the same nonces. The extranonce1
+// of a closed session is handed out again.
+type Server struct {
+	Handler        Handler
+	ExtranonceSize int
+
+	mu         sync.Mutex // protects the fields below
+	sessions   map[*Session]struct{}
+	next       uint64   // lowest extranonce1 never handed out
+	free       []uint64 // extranonce1s of closed sessions
+	difficulty float64
+	job        []interface{} // params of the last mining.notify
+	listener   net.Listener
+}
+
+// NewServer returns a server that hands out extranonceSize byte prefixes.
+func NewServer(h Handler, extranonceSize int) *Server {
+	return &Server{
+		Handler:        h,
+		ExtranonceSize: extranonceSize,
+		sessions:       make(map[*Session]struct{}),
+		difficulty:     1,
+	}
+}
+
+// Serve accepts connections on l until it is closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		sess, err := s.newSession(conn)
+		if err != nil {
+			log.Println("stratum", "addr:", conn.RemoteAddr(), "err:", err)
+			conn.Close()
+			continue
+		}
+		go sess.serve()
+	}
+}
+
+// Close stops accepting and drops every session.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for sess := range s.sessions {
+		sess.conn.Close()
+	}
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+// Sessions returns the number of connected miners.
+func (s *Server) Sessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// Notify announces a job to every subscribed session and to later ones.
+func (s *Server) Notify(jobID string, header [32]byte, height uint64, clean bool) {
+	params := []interface{}{jobID, hex.EncodeToString(header[:]), clean, height}
+	s.mu.Lock()
+	s.job = params
+	sessions := s.list()
+	s.mu.Unlock()
+
+	for _, sess := range sessions {
+		if sess.isSubscribed() {
+			sess.send(&Request{Method: "mining.notify", Params: params})
+		}
+	}
+}
+
+// SetDifficulty changes the share difficulty of every session. It applies
+// to jobs notified afterwards.
+func (s *Server) SetDifficulty(d float64) {
+	s.mu.Lock()
+	s.difficulty = d
+	sessions := s.list()
+	s.mu.Unlock()
+
+	for _, sess := range sessions {
+		if sess.isSubscribed() {
+			sess.send(&Request{Method: "mining.set_difficulty", Params: []interface{}{d}})
+		}
+	}
+}
+
+// Difficulty returns the current share difficulty.
+func (s *Server) Difficulty() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.difficulty
+}
+
+func (s *Server) list() []*Session {
+	sessions := make([]*Session, 0, len(s.sessions))
+	for sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	return sessions
+}
+
+func (s *Server) newSession(conn net.Conn) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ExtranonceSize < 0 || s.ExtranonceSize >= NonceSize {
+		return nil, fmt.Errorf("invalid extranonce size %d", s.ExtranonceSize)
+	}
+	var prefix uint64
+	if len(s.free) > 0 {
+		// the one closed longest ago, whose shares are the least likely
+		// to be for the current job
+		prefix, s.free = s.free[0], s.free[1:]
+	} else {
+		if s.next>>(8*uint(s.ExtranonceSize)) != 0 {
+			return nil, fmt.Errorf("extranonce space exhausted")
+		}
+		prefix = s.next
+		s.next++
+	}
+	var b [NonceSize]byte
+	binary.BigEndian.PutUint64(b[:], prefix)
+
+	sess := &Session{
+		Extranonce1: b[NonceSize-s.ExtranonceSize:],
+		Addr:        conn.RemoteAddr(),
+		server:      s,
+		conn:        conn,
+		prefix:      prefix,
+		enc:         json.NewEncoder(conn),
+		workers:     make(map[string]bool),
+	}
+	s.sessions[sess] = struct{}{}
+	return sess, nil
+}
+
+func (sess *Session) serve() {
+	defer func() {
+		sess.conn.Close()
+		sess.server.mu.Lock()
+		delete(sess.server.sessions, sess)
+		sess.server.free = append(sess.server.free, sess.prefix)
+		sess.server.mu.Unlock()
+	}()
+
+	dec := json.NewDecoder(bufio.NewReader(sess.conn))
+	for {
+		var msg message
+		if err := dec.Decode(&msg); err != nil {
+			return
+		}
+		var params []json.RawMessage
+		json.Unmarshal(msg.Params, &params)
+
+		result, err := sess.handle(msg.Method, params)
+		res := &Response{ID: msg.ID, Result: result}
+		if err != nil {
+			res.Result = nil
+			if res.Error, _ = err.(*Error); res.Error == nil {
+				res.Error = &Error{Code: CodeOther, Message: err.Error()}
+			}
+		}
+		if sess.send(res) != nil {
+			return
+		}
+		if msg.Method == "mining.subscribe" && err == nil {
+			sess.sendWork()
+		}
+	}
+}
+
+// sendWork brings a freshly subscribed session up to date.
+func (sess *Session) sendWork() {
+	s := sess.server
+	s.mu.Lock()
+	difficulty, job := s.difficulty, s.job
+	s.mu.Unlock()
+
+	sess.send(&Request{Method: "mining.set_difficulty", Params: []interface{}{difficulty}})
+	if job != nil {
+		sess.send(&Request{Method: "mining.notify", Params: job})
+	}
+}
+
+func (sess *Session) handle(method string, params []json.RawMessage) (interface{}, error) {
+	s := sess.server
+	str := func(i int) string {
+		var v string
+		if i < len(params) {
+			json.Unmarshal(params[i], &v)
+		}
+		return v
+	}
+
+	switch method {
+	case "mining.subscribe":
+		sess.mu.Lock()
+		sess.subscribed = true
+		sess.mu.Unlock()
+		return []interface{}{
+			[][]string{{"mining.notify", hex.EncodeToString(sess.Extranonce1)}},
+			hex.EncodeToString(sess.Extranonce1),
+			NonceSize - len(sess.Extranonce1),
+		}, nil
+
+	case "mining.extranonce.subscribe":
+		// the extranonce1 of a session never changes
+		return true, nil
+
+	case "mining.authorize":
+		user := str(0)
+		if !s.Handler.Authorize(sess, user, str(1)) {
+			return false, nil
+		}
+		sess.mu.Lock()
+		sess.workers[user] = true
+		sess.mu.Unlock()
+		return true, nil
+
+	case "mining.submit":
+		user := str(0)
+		sess.mu.Lock()
+		subscribed, authorized := sess.subscribed, sess.workers[user]
+		sess.mu.Unlock()
+		if !subscribed {
+			return nil, &Error{Code: CodeNotSubscribed, Message: "not subscribed"}
+		}
+		if !authorized {
+			return nil, &Error{Code: CodeUnauthorized, Message: "unauthorized worker"}
+		}
+		e2, err := decodeHex(str(2), NonceSize-len(sess.Extranonce1))
+		if err != nil {
+			return nil, &Error{Code: CodeOther, Message: fmt.Sprintf("extranonce2: %v", err)}
+		}
+		job := &Job{Extranonce1: sess.Extranonce1}
+		if err := s.Handler.Submit(sess, user, str(1), job.Nonce(e2)); err != nil {
+			return nil, err
+		}
+		return true, nil
+	}
+	return nil, &Error{Code: CodeOther, Message: "unknown method " + method}
+}
+
+func (sess *Session) isSubscribed() bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.subscribed
+}
+
+func (sess *Session) send(v interface{}) error {
+	sess.wmu.Lock()
+	defer sess.wmu.Unlock()
+	return sess.enc.Encode(v)
+}
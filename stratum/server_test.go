@@ -0,0 +1,85 @@
+package stratum
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type testHandler struct{}
+
+func (testHandler) Authorize(s *Session, user, pass string) bool { return true }
+
+func (testHandler) Submit(s *Session, user, jobID string, nonce uint64) error { return nil }
+
+// dial connects a subscribed client to the server listening on l.
+func dial(t *testing.T, l net.Listener) *Client {
+	c, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Subscribe("test"); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func extranonce1(c *Client) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return string(c.extranonce1)
+}
+
+func TestServerReusesExtranonce(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(testHandler{}, 2)
+	go s.Serve(l)
+	defer s.Close()
+
+	a, b := dial(t, l), dial(t, l)
+	defer b.Close()
+	if extranonce1(a) == extranonce1(b) {
+		t.Fatalf("two sessions got extranonce1 %x", extranonce1(a))
+	}
+
+	// the extranonce1 of a closed session is handed out again
+	closed := extranonce1(a)
+	a.Close()
+	for deadline := time.Now().Add(5 * time.Second); s.Sessions() != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("closed session not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c := dial(t, l)
+	defer c.Close()
+	if extranonce1(c) != closed {
+		t.Fatalf("new session got extranonce1 %x, want %x of the closed one", extranonce1(c), closed)
+	}
+}
+
+func TestServerExtranonceExhausted(t *testing.T) {
+	s := NewServer(testHandler{}, 1)
+	s.next = 0xff
+
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	sess, err := s.newSession(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.Extranonce1[0] != 0xff {
+		t.Fatalf("got extranonce1 %x, want ff", sess.Extranonce1)
+	}
+	if _, err := s.newSession(conn); err == nil {
+		t.Fatal("extranonce1 handed out past the space")
+	}
+	s.free = append(s.free, sess.prefix)
+	if again, err := s.newSession(conn); err != nil || again.Extranonce1[0] != 0xff {
+		t.Fatalf("freed extranonce1 not handed out again: %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/classzz/classzz/btcjson"
+	"github.com/classzz/miner-gpu/czzhash"
+	"github.com/classzz/miner-gpu/stratum"
+)
+
+const (
+	// maxResets is how often in a row a device may fail before it is
+	// given up on.
+	maxResets = 5
+	// submitRetries is how often a failed SubmitWork is retried.
+	submitRetries = 4
+	// submitQueue is how many nonces may wait for their answer before a
+	// device that finds another one waits for the submitter.
+	submitQueue = 64
+)
+
+// deviceState is what the supervisor knows about one device.
+type deviceState struct {
+	failures int // in a row
+	disabled bool
+}
+
+// supervisor keeps the miner running through device and RPC failures.
+// Devices whose Search fails are reinitialised with exponential backoff on
+// the goroutine that searched on them, so a reset never outlives the device
+// loops; a device that keeps failing or whose kernel does not build is
+// disabled.
+type supervisor struct {
+	cl   czzhash.Searcher
+	quit <-chan struct{}
+
+	mu      sync.Mutex // protects devices
+	devices map[czzhash.DeviceID]*deviceState
+}
+
+func newSupervisor(cl czzhash.Searcher, quit <-chan struct{}) *supervisor {
+	return &supervisor{
+		cl:      cl,
+		quit:    quit,
+		devices: make(map[czzhash.DeviceID]*deviceState),
+	}
+}
+
+func (s *supervisor) device(id czzhash.DeviceID) *deviceState {
+	d, ok := s.devices[id]
+	if !ok {
+		d = &deviceState{}
+		s.devices[id] = d
+	}
+	return d
+}
+
+// Disabled reports whether the device has been given up on.
+func (s *supervisor) Disabled(id czzhash.DeviceID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.device(id).disabled
+}
+
+// Succeeded records a Search that ended without error.
+func (s *supervisor) Succeeded(id czzhash.DeviceID) {
+	s.mu.Lock()
+	s.device(id).failures = 0
+	s.mu.Unlock()
+}
+
+// Failed records a failed Search and reinitialises the device, waiting out
+// the backoff before each try, until a reset works, the device is disabled
+// or quit is closed.
+func (s *supervisor) Failed(id czzhash.DeviceID, err error) {
+	for {
+		s.mu.Lock()
+		d := s.device(id)
+		d.failures++
+		failures := d.failures
+		if errors.Is(err, czzhash.ErrBuildFailure) || failures > maxResets {
+			d.disabled = true
+		}
+		disabled := d.disabled
+		s.mu.Unlock()
+
+		if disabled {
+			log.Println("Device disabled", "device:", id, "failures:", failures, "err:", err)
+			return
+		}
+		log.Println("Device failed", "device:", id, "failures:", failures, "err:", err)
+
+		select {
+		case <-time.After(backoff(failures)):
+		case <-s.quit:
+			return
+		}
+		if err = s.cl.Reset(id); err == nil {
+			log.Println("Device reset", "device:", id)
+			return
+		}
+	}
+}
+
+// Submit waits for the answer to nonce, sent to source as result, and sends
+// it again on transient errors with backoff until the work goes stale.
+// Rejections by the node or pool are not retried.
+func (s *supervisor) Submit(source WorkSource, w *Work, nonce uint64, result SubmitFuture) error {
+	for attempt := 1; ; attempt++ {
+		err := result.Receive()
+		if err == nil || permanent(err) || attempt > submitRetries {
+			return err
+		}
+		wait := backoff(attempt)
+		log.Println("SubmitWork", "err", err, "retry in:", wait)
+		select {
+		case <-time.After(wait):
+		case <-w.Stale:
+			return err
+		case <-s.quit:
+			return err
+		}
+		result = source.SubmitWorkAsync(w, nonce)
+	}
+}
+
+// permanent reports whether err is an answer of the upstream rather than a
+// failure to reach it. Sending a share the upstream answered again only gets
+// it counted as a duplicate.
+func permanent(err error) bool {
+	switch err.(type) {
+	case *stratum.Error, *btcjson.RPCError, *rejectedError:
+		return true
+	}
+	return false
+}
+
+// rejectedError is an answer of a node refusing a share, see getworkSubmit.
+type rejectedError struct {
+	err error
+}
+
+func (e *rejectedError) Error() string { return e.err.Error() }
+
+// backoff returns the wait before retry n, doubling from a second up to a
+// minute.
+func backoff(n int) time.Duration {
+	if n < 1 {
+		n = 1
+	}
+	if n > 7 {
+		return time.Minute
+	}
+	return time.Second << uint(n-1)
+}
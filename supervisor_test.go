@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testNode answers submitwork with the replies in turn, the last one for
+// every further call.
+type testNode struct {
+	mu      sync.Mutex
+	replies []func(w http.ResponseWriter, id json.RawMessage)
+	submits int
+}
+
+func (n *testNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     json.RawMessage
+		Method string
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	n.mu.Lock()
+	n.submits++
+	reply := n.replies[0]
+	if len(n.replies) > 1 {
+		n.replies = n.replies[1:]
+	}
+	n.mu.Unlock()
+	reply(w, req.ID)
+}
+
+// result replies with a JSON-RPC result.
+func result(v interface{}) func(w http.ResponseWriter, id json.RawMessage) {
+	return func(w http.ResponseWriter, id json.RawMessage) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": v, "error": nil, "id": id})
+	}
+}
+
+func submitToNode(t *testing.T, node *testNode) error {
+	srv := httptest.NewServer(node)
+	defer srv.Close()
+	client, err := dialNode(strings.TrimPrefix(srv.URL, "http://"), "user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Shutdown()
+
+	source := &getworkSource{client: client}
+	quit := make(chan struct{})
+	defer close(quit)
+	s := newSupervisor(nil, quit)
+	w := &Work{ID: "ab"}
+	return s.Submit(source, w, 1, source.SubmitWorkAsync(w, 1))
+}
+
+// TestSubmitRejectedByNode checks that a share the node answered with a
+// rejection, which rpcclient returns as a plain error, is not sent again.
+func TestSubmitRejectedByNode(t *testing.T) {
+	node := &testNode{replies: []func(http.ResponseWriter, json.RawMessage){result("duplicate share")}}
+	err := submitToNode(t, node)
+	if err == nil || !permanent(err) || err.Error() != "duplicate share" {
+		t.Fatalf("got %v, want the rejection of the node", err)
+	}
+	if node.submits != 1 {
+		t.Fatalf("share sent %d times, want once", node.submits)
+	}
+}
+
+// TestSubmitRetriesUnreadableReply checks that a share whose answer did not
+// come through is sent again.
+func TestSubmitRetriesUnreadableReply(t *testing.T) {
+	busy := func(w http.ResponseWriter, id json.RawMessage) {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}
+	node := &testNode{replies: []func(http.ResponseWriter, json.RawMessage){busy, result(nil)}}
+	if err := submitToNode(t, node); err != nil {
+		t.Fatalf("got %v, want the share accepted on the retry", err)
+	}
+	if node.submits != 2 {
+		t.Fatalf("share sent %d times, want twice", node.submits)
+	}
+}
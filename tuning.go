@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/classzz/miner-gpu/czzhash"
+)
+
+// tuningFile is the file name of the autotune cache in the data directory.
+const tuningFile = "tuning.json"
+
+var (
+	// tuneWorkGroupSizes are the work group sizes autotune tries, as far as
+	// the device allows them.
+	tuneWorkGroupSizes = []int{16, 32, 64, 128, 256}
+	// tuneBatchMultipliers are the batch multipliers autotune tries.
+	tuneBatchMultipliers = []int{1, 2, 4, 8, 16, 32}
+)
+
+// tuning is the best setting autotune found for a kind of device.
+type tuning struct {
+	WorkGroupSize   int       `json:"worksize"`
+	BatchMultiplier int       `json:"batch"`
+	HashRate        float64   `json:"hashrate"`
+	Tuned           time.Time `json:"tuned"`
+}
+
+// tuningKey is what the settings of a device are cached under. Cards of the
+// same model on the same driver share their settings.
+func tuningKey(d *czzhash.DeviceInfo) string {
+	return d.Name + " / " + d.DriverVersion
+}
+
+// loadTuning reads the autotune cache at path, a missing cache is empty.
+func loadTuning(path string) (map[string]tuning, error) {
+	cache := make(map[string]tuning)
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return cache, err
+	}
+	if err := json.Unmarshal(b, &cache); err != nil {
+		return make(map[string]tuning), err
+	}
+	return cache, nil
+}
+
+// saveTuning writes the autotune cache to path, replacing it atomically.
+func saveTuning(path string, cache map[string]tuning) error {
+	b, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// autotune benchmarks every combination of work group size and batch
+// multiplier on each selected GPU and caches the fastest, which mining then
+// picks up on its own.
+func autotune(args []string) {
+	fs := flag.NewFlagSet("autotune", flag.ExitOnError)
+	var DurationFlag = fs.Duration("duration", 3*time.Second, "How long each setting is benchmarked")
+	var TuningFlag = fs.String("tuning", filepath.Join(czzhash.DefaultDataDir(), tuningFile), "Cache to store the best settings in")
+	var DevicesFlag = fs.String("devices", "", "Comma separated GPUs to tune, as for mining; all if empty")
+	var ExcludeFlag = fs.String("exclude", "", "Comma separated GPUs not to tune")
+	table := tableFlags(fs)
+	fs.Parse(args)
+
+	all, err := czzhash.Devices()
+	if err != nil {
+		log.Fatal("devices", "err", err)
+	}
+	selected, err := czzhash.SelectDevices(all, splitList(*DevicesFlag), splitList(*ExcludeFlag))
+	if err != nil {
+		log.Fatal("devices", "err", err)
+	}
+	cache, err := loadTuning(*TuningFlag)
+	if err != nil {
+		log.Println("WARNING: tuning cache not loaded, starting afresh", "path:", *TuningFlag, "err:", err)
+	}
+	cfg := table()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tNAME\tWORKSIZE\tBATCH\tHASHRATE")
+	for i := range selected {
+		d := &selected[i]
+		best, ok := tuneDevice(d, cfg, *DurationFlag)
+		if !ok {
+			fmt.Fprintf(w, "%s\t%s\t\t\tno setting worked\n", d.ID, d.Name)
+			continue
+		}
+		cache[tuningKey(d)] = best
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%.1f H/s\n", d.ID, d.Name, best.WorkGroupSize, best.BatchMultiplier, best.HashRate)
+	}
+	w.Flush()
+
+	if err := saveTuning(*TuningFlag, cache); err != nil {
+		log.Fatal("tuning", "err", err)
+	}
+	log.Println("Tuning saved", "path:", *TuningFlag)
+}
+
+// tuneDevice returns the fastest setting for d.
+func tuneDevice(d *czzhash.DeviceInfo, table czzhash.TableConfig, duration time.Duration) (tuning, bool) {
+	var best tuning
+	round := time.Second
+	if duration < round {
+		round = duration
+	}
+	for _, ws := range tuneWorkGroupSizes {
+		if ws > d.MaxWorkGroupSize {
+			break
+		}
+		for _, batch := range tuneBatchMultipliers {
+			cfg := czzhash.DeviceConfig{ID: d.ID, WorkGroupSize: ws, BatchMultiplier: batch}
+			Cl := czzhash.NewCL([]czzhash.DeviceConfig{cfg}, table)
+			if err := Cl.Init(0); err != nil {
+				log.Println("Autotune", "device:", d.ID, "worksize:", ws, "batch:", batch, "err:", err)
+				Cl.Close()
+				continue
+			}
+			s := benchDevice(Cl, d.ID, duration, 0, round)
+			Cl.Close()
+			if s.err != nil {
+				log.Println("Autotune", "device:", d.ID, "worksize:", ws, "batch:", batch, "err:", s.err)
+				continue
+			}
+			rate := float64(s.nonces) / s.elapsed.Seconds()
+			log.Println("Autotune", "device:", d.ID, "worksize:", ws, "batch:", batch, "hashrate:", rate)
+			if rate > best.HashRate {
+				best = tuning{WorkGroupSize: ws, BatchMultiplier: batch, HashRate: rate, Tuned: time.Now().UTC()}
+			}
+		}
+	}
+	return best, best.HashRate > 0
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"log"
+	"math/big"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/classzz/classzz/rpcclient"
+	"github.com/classzz/classzz/wire"
+	"github.com/classzz/czzutil"
+	"github.com/classzz/miner-gpu/czzhash"
+	"github.com/classzz/miner-gpu/stratum"
+)
+
+// Work is one header to search, from a node or a pool.
+type Work struct {
+	ID     string // getwork hash or stratum job id
+	Header czzhash.Hash
+	Target *big.Int
+	Height uint64 // of the block mined, 0 if unknown
+
+	// NoncePrefix holds the nonce bits fixed by the pool, NonceMask the bits
+	// the miner may choose.
+	NoncePrefix uint64
+	NonceMask   uint64
+
+	// Stale is closed once the work is outdated, nil if that is never known.
+	Stale <-chan struct{}
+
+	src WorkSource // the source the work came from, for failover
+	job *stratum.Job
+}
+
+// WorkSource hands out work and takes the nonces found for it. Closing a
+// source makes the work it handed out stale.
+type WorkSource interface {
+	GetWork() (*Work, error)
+	// SubmitWorkAsync sends nonce for w without waiting for the answer.
+	SubmitWorkAsync(w *Work, nonce uint64) SubmitFuture
+	Close()
+}
+
+// SubmitFuture is the answer to a nonce sent with SubmitWorkAsync.
+type SubmitFuture interface {
+	// Receive waits for the answer, nil if the nonce was accepted. It may
+	// only be called once.
+	Receive() error
+}
+
+// dialNode connects to the RPC server of a classzz node.
+func dialNode(host, user, pass string) (*rpcclient.Client, error) {
+	connCfg := &rpcclient.ConnConfig{
+		Host:         host,
+		Endpoint:     "http",
+		User:         user,
+		Pass:         pass,
+		HTTPPostMode: true, // Bitcoin core only supports HTTP POST mode
+		DisableTLS:   true, // Bitcoin core does not provide TLS by default
+	}
+
+	// Notice the notification parameter is nil since notifications are
+	// not supported in HTTP POST mode.
+	return rpcclient.New(connCfg, nil)
+}
+
+// nextHeight returns the height of the block getwork is for, 0 if the node
+// cannot tell.
+func nextHeight(client *rpcclient.Client) uint64 {
+	count, err := client.GetBlockCount()
+	if err != nil {
+		log.Println("GetBlockCount", "err", err)
+		return 0
+	}
+	return uint64(count) + 1
+}
+
+// getworkSource mines against a single node with getwork/submitwork. The
+// chain tip is watched so that work can be dropped as soon as a new block
+// connects: through websocket block notifications, or by polling the best
+// block hash when the node is used in HTTP POST mode.
+type getworkSource struct {
+	client *rpcclient.Client
+	quit   chan struct{}
+
+	mu    sync.Mutex // protects the fields below
+	tip   string
+	stale chan struct{} // closed when a block connects
+}
+
+// newGetworkSource connects to the node at host. With websocket set, block
+// notifications are used, otherwise the tip is polled every poll interval.
+func newGetworkSource(host, user, pass string, websocket bool, poll time.Duration) (*getworkSource, error) {
+	s := &getworkSource{
+		quit:  make(chan struct{}),
+		stale: make(chan struct{}),
+	}
+
+	var err error
+	if !websocket {
+		if s.client, err = dialNode(host, user, pass); err != nil {
+			return nil, err
+		}
+		s.syncTip()
+		go s.poll(poll)
+		return s, nil
+	}
+
+	connCfg := &rpcclient.ConnConfig{
+		Host:       host,
+		Endpoint:   "ws",
+		User:       user,
+		Pass:       pass,
+		DisableTLS: true, // Bitcoin core does not provide TLS by default
+	}
+	ready := make(chan struct{}) // closed once s.client is set
+	ntfnHandlers := &rpcclient.NotificationHandlers{
+		// on connect and on every reconnect, so that the first block
+		// notified afterwards, or one missed meanwhile, makes work stale
+		OnClientConnected: func() {
+			<-ready
+			if s.client != nil {
+				s.syncTip()
+			}
+		},
+		OnFilteredBlockConnected: func(height int32, header *wire.BlockHeader, txs []*czzutil.Tx) {
+			s.newTip(header.BlockHash().String())
+		},
+	}
+	s.client, err = rpcclient.New(connCfg, ntfnHandlers)
+	close(ready)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.client.NotifyBlocks(); err != nil {
+		s.client.Shutdown()
+		return nil, err
+	}
+	return s, nil
+}
+
+// poll checks the best block hash every interval.
+func (s *getworkSource) poll(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.quit:
+			return
+		}
+		s.syncTip()
+	}
+}
+
+// syncTip checks the best block hash of the node.
+func (s *getworkSource) syncTip() {
+	hash, err := s.client.GetBestBlockHash()
+	if err != nil {
+		log.Println("GetBestBlockHash", "err", err)
+		return
+	}
+	s.newTip(hash.String())
+}
+
+// newTip marks the current work stale if hash is not the known tip.
+func (s *getworkSource) newTip(hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if hash == s.tip {
+		return
+	}
+	if s.tip != "" {
+		log.Println("New block", "hash:", hash)
+		close(s.stale)
+		s.stale = make(chan struct{})
+	}
+	s.tip = hash
+}
+
+func (s *getworkSource) GetWork() (*Work, error) {
+	// taken before GetWork, a block connecting in between makes the work stale
+	s.mu.Lock()
+	stale := s.stale
+	s.mu.Unlock()
+
+	work, err := s.client.GetWork()
+	if err != nil {
+		return nil, err
+	}
+	log.Println("GetWork", "Hash", work.Hash, "Target", work.Target)
+
+	target, err := czzhash.ParseTarget(work.Target)
+	if err != nil {
+		return nil, err
+	}
+	w := &Work{ID: work.Hash, Target: target, Height: nextHeight(s.client), NonceMask: ^uint64(0), Stale: stale}
+	w.Header.SetBytes([]byte(work.Hash))
+	return w, nil
+}
+
+func (s *getworkSource) SubmitWorkAsync(w *Work, nonce uint64) SubmitFuture {
+	return getworkSubmit(s.client.SubmitWorkAsync(w.ID, nonce))
+}
+
+// getworkSubmit is the SubmitFuture of submitwork. rpcclient returns the
+// rejection of a node as a plain error, so every error but a failure to reach
+// the node is returned as *rejectedError.
+type getworkSubmit rpcclient.FutureSubmitBlockResult
+
+// Receive implements SubmitFuture.
+func (f getworkSubmit) Receive() error {
+	err := rpcclient.FutureSubmitBlockResult(f).Receive()
+	if err == nil || unreachable(err) {
+		return err
+	}
+	return &rejectedError{err}
+}
+
+// unreachable reports whether err of an RPC means the node was not reached
+// or its answer did not come through.
+func unreachable(err error) bool {
+	switch err {
+	case rpcclient.ErrClientNotConnected, rpcclient.ErrClientDisconnect, rpcclient.ErrClientShutdown:
+		return true
+	}
+	switch err.(type) {
+	case *url.Error, net.Error:
+		return true
+	}
+	// rpcclient has no types for a reply it cannot read
+	msg := err.Error()
+	return strings.HasPrefix(msg, "error reading json reply") || strings.HasPrefix(msg, "status code: ")
+}
+
+func (s *getworkSource) Close() {
+	close(s.quit)
+	s.client.Shutdown()
+
+	s.mu.Lock()
+	close(s.stale)
+	s.stale = make(chan struct{})
+	s.mu.Unlock()
+}
+
+// stratumSource mines for a pool. Jobs are tracked in the background so the
+// current search can be abandoned as soon as the pool cleans its jobs.
+type stratumSource struct {
+	client *stratum.Client
+	user   string
+
+	mu    sync.Mutex // protects the fields below
+	job   *stratum.Job
+	stale chan struct{} // closed when job is superseded by a clean job
+	ready chan struct{} // closed once the first job is in
+}
+
+func newStratumSource(url, user, pass string) (*stratumSource, error) {
+	client, err := stratum.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	if err = client.Subscribe("miner-gpu"); err != nil {
+		client.Close()
+		return nil, err
+	}
+	if err = client.Authorize(user, pass); err != nil {
+		client.Close()
+		return nil, err
+	}
+	// a new extranonce1 comes with the current job in the new nonce space,
+	// so an exhausted job is mined on without waiting for the next one
+	if err = client.SubscribeExtranonce(); err != nil {
+		log.Println("Extranonce subscribe", "err", err)
+	}
+
+	s := &stratumSource{
+		client: client,
+		user:   user,
+		stale:  make(chan struct{}),
+		ready:  make(chan struct{}),
+	}
+	go s.track()
+	return s, nil
+}
+
+func (s *stratumSource) track() {
+	for {
+		select {
+		case job := <-s.client.Jobs():
+			log.Println("Notify", "job:", job.ID, "clean:", job.Clean, "target:", job.Target)
+			s.mu.Lock()
+			if s.job == nil {
+				close(s.ready)
+			} else if job.Clean {
+				close(s.stale)
+				s.stale = make(chan struct{})
+			}
+			s.job = job
+			s.mu.Unlock()
+
+		case <-s.client.Done():
+			s.mu.Lock()
+			close(s.stale)
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (s *stratumSource) GetWork() (*Work, error) {
+	select {
+	case <-s.ready:
+	case <-s.client.Done():
+		return nil, s.client.Err()
+	}
+	select {
+	case <-s.client.Done():
+		return nil, s.client.Err()
+	default:
+	}
+
+	s.mu.Lock()
+	job, stale := s.job, s.stale
+	s.mu.Unlock()
+
+	mask := ^uint64(0)
+	if job.Extranonce2Size < stratum.NonceSize {
+		mask = 1<<(8*uint(job.Extranonce2Size)) - 1
+	}
+	return &Work{
+		ID:          job.ID,
+		Header:      job.Header,
+		Target:      job.Target,
+		Height:      job.Height,
+		NoncePrefix: job.Nonce(nil),
+		NonceMask:   mask,
+		Stale:       stale,
+		job:         job,
+	}, nil
+}
+
+// SubmitWorkAsync submits on a goroutine of its own, the stratum client
+// only has a blocking Submit.
+func (s *stratumSource) SubmitWorkAsync(w *Work, nonce uint64) SubmitFuture {
+	r := make(submitResult, 1)
+	go func() {
+		r <- s.client.Submit(s.user, w.job, nonce)
+	}()
+	return r
+}
+
+// submitResult is the SubmitFuture of a submission made on a goroutine.
+type submitResult chan error
+
+// Receive implements SubmitFuture.
+func (r submitResult) Receive() error {
+	return <-r
+}
+
+func (s *stratumSource) Close() {
+	s.client.Close()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/classzz/miner-gpu/czzhash"
+	"github.com/classzz/miner-gpu/stratum"
+)
+
+// testPool is the Handler of the in-process pool of TestStratumSource.
+type testPool struct {
+	mu     sync.Mutex // protects job
+	job    string
+	shares chan uint64
+}
+
+func (p *testPool) Authorize(s *stratum.Session, user, pass string) bool {
+	return user == "test"
+}
+
+func (p *testPool) Submit(s *stratum.Session, user, jobID string, nonce uint64) error {
+	p.mu.Lock()
+	job := p.job
+	p.mu.Unlock()
+	if jobID != job {
+		return &stratum.Error{Code: stratum.CodeJobNotFound, Message: "job not found"}
+	}
+	p.shares <- nonce
+	return nil
+}
+
+// TestStratumSource mines one job of an in-process stratum pool through
+// stratumSource: the job and difficulty have to arrive intact, the submitted
+// nonce has to keep the pool's extranonce, a clean job has to make the work
+// stale and shares for it have to be rejected.
+func TestStratumSource(t *testing.T) {
+	pool := &testPool{job: "1", shares: make(chan uint64, 1)}
+	server := stratum.NewServer(pool, 4)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	defer server.Close()
+
+	var header czzhash.Hash
+	header.SetBytes([]byte("czzhash-test"))
+	server.SetDifficulty(2)
+	server.Notify("1", header, 0, true)
+
+	if _, err := newStratumSource("stratum+tcp://"+l.Addr().String(), "nobody", ""); err == nil {
+		t.Fatal("unknown worker authorized")
+	}
+	source, err := newStratumSource("stratum+tcp://"+l.Addr().String(), "test", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	work, err := source.GetWork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if work.ID != "1" || work.Header != header {
+		t.Fatalf("got job %s header %x, want 1 %x", work.ID, work.Header, header)
+	}
+	if want := stratum.DifficultyToTarget(2); work.Target.Cmp(want) != 0 {
+		t.Fatalf("got target %x, want %x", work.Target, want)
+	}
+
+	nonces, err := newNonceAllocator(5, 4, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	space, err := nonces.job(work)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := nonces.take(space)
+	nonce := r.Start
+	if nonce&^work.NonceMask != work.NoncePrefix || work.NonceMask != 0xffffffff {
+		t.Fatalf("nonce %#x outside the extranonce2 space", nonce)
+	}
+	if rig := nonce >> 28 & 0xf; rig != 5 || !r.Contains(nonce+r.Count-1) || (nonce+r.Count-1)&^work.NonceMask != work.NoncePrefix {
+		t.Fatalf("nonce range %#x+%d outside the space of rig 5", nonce, r.Count)
+	}
+	if err := source.SubmitWorkAsync(work, nonce).Receive(); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-pool.shares; got != nonce {
+		t.Fatalf("pool got nonce %#x, want %#x", got, nonce)
+	}
+
+	pool.mu.Lock()
+	pool.job = "2"
+	pool.mu.Unlock()
+	server.Notify("2", czzhash.Hash{}, 0, true)
+	select {
+	case <-work.Stale:
+	case <-time.After(5 * time.Second):
+		t.Fatal("clean job did not make the work stale")
+	}
+	err = source.SubmitWorkAsync(work, nonce).Receive()
+	if rejected, ok := err.(*stratum.Error); !ok || rejected.Code != stratum.CodeJobNotFound {
+		t.Fatalf("stale share: got %v, want code %d", err, stratum.CodeJobNotFound)
+	}
+
+	if d := stratum.TargetToDifficulty(stratum.DifficultyToTarget(4)); math.Abs(d-4) > 1e-9 {
+		t.Fatalf("difficulty 4 round trips to %v", d)
+	}
+}